@@ -0,0 +1,13 @@
+INSERT IGNORE INTO permissions (permission_id, name) VALUES (1, 'Manage Organization');
+INSERT IGNORE INTO permissions (permission_id, name) VALUES (2, 'Manage Users');
+INSERT IGNORE INTO permissions (permission_id, name) VALUES (3, 'Manage Self');
+
+-- User
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (1, 3);
+-- Admin
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (2, 2);
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (2, 3);
+-- Super User
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (3, 1);
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (3, 2);
+INSERT IGNORE INTO role_permissions (role_id, permission_id) VALUES (3, 3);
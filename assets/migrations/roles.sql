@@ -0,0 +1,3 @@
+INSERT IGNORE INTO roles (role_id, name) VALUES (1, 'User');
+INSERT IGNORE INTO roles (role_id, name) VALUES (2, 'Admin');
+INSERT IGNORE INTO roles (role_id, name) VALUES (3, 'Super User');
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	refresh_token_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	device_id varchar(255) NOT NULL DEFAULT '',
+	family_id varchar(64) NOT NULL,
+	token_hash char(64) NOT NULL,
+	expires_on datetime NOT NULL,
+	rotated_on datetime NULL,
+	revoked_on datetime NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(token_hash),
+	INDEX(family_id),
+	CONSTRAINT refresh_tokens_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(refresh_token_id)
+) ENGINE=InnoDB CHARSET=utf8;
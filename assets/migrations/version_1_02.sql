@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti varchar(64) NOT NULL,
+	user_id bigint unsigned NOT NULL,
+	expires_on datetime NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX(expires_on),
+	PRIMARY KEY(jti)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+	user_id bigint unsigned NOT NULL,
+	revoked_before datetime NOT NULL,
+	updated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	CONSTRAINT user_token_revocations_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id)
+) ENGINE=InnoDB CHARSET=utf8;
@@ -0,0 +1,36 @@
+CREATE TABLE IF NOT EXISTS roles (
+	role_id bigint unsigned NOT NULL,
+	name varchar(255) NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(role_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS permissions (
+	permission_id bigint unsigned NOT NULL,
+	name varchar(255) NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY(permission_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id bigint unsigned NOT NULL,
+	permission_id bigint unsigned NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT role_permissions_fk1 FOREIGN KEY (role_id)
+		REFERENCES roles (role_id) ON DELETE CASCADE,
+	CONSTRAINT role_permissions_fk2 FOREIGN KEY (permission_id)
+		REFERENCES permissions (permission_id) ON DELETE CASCADE,
+	PRIMARY KEY(role_id, permission_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id bigint unsigned NOT NULL,
+	role_id bigint unsigned NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT user_roles_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id, role_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+INSERT IGNORE INTO user_roles (user_id, role_id)
+	SELECT user_id, 1 FROM users;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	api_key_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	name varchar(255) NOT NULL,
+	prefix varchar(16) NOT NULL,
+	key_hash char(64) NOT NULL,
+	scopes varchar(1024) NOT NULL DEFAULT '',
+	expires_on datetime NULL,
+	revoked_on datetime NULL,
+	last_used_on datetime NULL,
+	created_by bigint unsigned NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(prefix),
+	CONSTRAINT api_keys_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(api_key_id)
+) ENGINE=InnoDB CHARSET=utf8;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS user_mfa (
+	user_id bigint unsigned NOT NULL,
+	secret varchar(64) NOT NULL,
+	enabled boolean NOT NULL DEFAULT FALSE,
+	last_step bigint NOT NULL DEFAULT 0,
+	confirmed_on datetime NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	CONSTRAINT user_mfa_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+	recovery_code_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	code_hash char(64) NOT NULL,
+	used_on datetime NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX(user_id),
+	CONSTRAINT user_recovery_codes_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(recovery_code_id)
+) ENGINE=InnoDB CHARSET=utf8;
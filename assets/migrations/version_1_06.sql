@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+	login_attempt_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	email varchar(255) NOT NULL,
+	ip varchar(64) NOT NULL,
+	success boolean NOT NULL,
+	created_on datetime NOT NULL,
+	INDEX(email, created_on),
+	INDEX(ip, created_on),
+	PRIMARY KEY(login_attempt_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS account_locks (
+	account_lock_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	reason varchar(255) NOT NULL,
+	locked_on datetime NOT NULL,
+	locked_until datetime NOT NULL,
+	unlocked_on datetime NULL,
+	unlocked_by bigint unsigned NULL,
+	INDEX(user_id, locked_until),
+	CONSTRAINT account_locks_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(account_lock_id)
+) ENGINE=InnoDB CHARSET=utf8;
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN email_verified_on datetime NULL AFTER email;
+
+UPDATE users SET email_verified_on = created_on WHERE email_verified_on IS NULL;
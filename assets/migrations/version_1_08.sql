@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS password_resets (
+	password_reset_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	token_hash char(64) NOT NULL,
+	expires_on datetime NOT NULL,
+	used_on datetime NULL,
+	created_on datetime NOT NULL,
+	UNIQUE(token_hash),
+	INDEX(user_id),
+	CONSTRAINT password_resets_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(password_reset_id)
+) ENGINE=InnoDB CHARSET=utf8;
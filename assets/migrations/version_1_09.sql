@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS user_passwords (
+	user_password_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	password varchar(255) NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	INDEX(user_id, user_password_id),
+	CONSTRAINT user_passwords_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(user_password_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+ALTER TABLE users ADD COLUMN password_changed_on datetime NULL AFTER password;
+
+UPDATE users SET password_changed_on = created_on WHERE password_changed_on IS NULL;
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS oidc_logins (
+	oidc_login_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	provider varchar(64) NOT NULL,
+	state_hash char(64) NOT NULL,
+	nonce varchar(64) NOT NULL,
+	verifier varchar(128) NOT NULL,
+	user_id bigint unsigned NULL,
+	expires_on datetime NOT NULL,
+	used_on datetime NULL,
+	created_on datetime NOT NULL,
+	UNIQUE(state_hash),
+	CONSTRAINT oidc_logins_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(oidc_login_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	user_identity_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	provider varchar(64) NOT NULL,
+	subject varchar(255) NOT NULL,
+	email varchar(255) NOT NULL,
+	created_on datetime NOT NULL,
+	last_login_on datetime NULL,
+	UNIQUE(provider, subject),
+	INDEX(user_id),
+	CONSTRAINT user_identities_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(user_identity_id)
+) ENGINE=InnoDB CHARSET=utf8;
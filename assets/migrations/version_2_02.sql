@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+	session_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	device_id varchar(255) NOT NULL DEFAULT '',
+	user_agent varchar(512) NOT NULL DEFAULT '',
+	ip varchar(64) NOT NULL DEFAULT '',
+	created_on datetime NOT NULL,
+	last_seen_on datetime NOT NULL,
+	expires_on datetime NOT NULL,
+	revoked_on datetime NULL,
+	INDEX(user_id, revoked_on),
+	CONSTRAINT user_sessions_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(session_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+ALTER TABLE refresh_tokens ADD COLUMN session_id bigint unsigned NULL AFTER family_id;
+
+ALTER TABLE refresh_tokens ADD INDEX(session_id);
@@ -0,0 +1,20 @@
+ALTER TABLE users ADD COLUMN status tinyint NOT NULL DEFAULT 1 AFTER deleted;
+
+UPDATE users SET status = 2 WHERE deleted = true;
+
+CREATE TABLE IF NOT EXISTS user_invites (
+	invite_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NULL,
+	email varchar(255) NOT NULL,
+	invited_by bigint unsigned NOT NULL,
+	nonce varchar(64) NOT NULL,
+	sent_on datetime NOT NULL,
+	expires_on datetime NOT NULL,
+	accepted_on datetime NULL,
+	cancelled_on datetime NULL,
+	created_on datetime NOT NULL,
+	INDEX(user_id),
+	CONSTRAINT user_invites_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE SET NULL,
+	PRIMARY KEY(invite_id)
+) ENGINE=InnoDB CHARSET=utf8;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS organizations (
+	organization_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	parent_id bigint unsigned NULL,
+	org_type tinyint NOT NULL DEFAULT 1,
+	name varchar(255) NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	deleted boolean NOT NULL DEFAULT FALSE,
+	INDEX(parent_id),
+	CONSTRAINT organizations_fk1 FOREIGN KEY (parent_id)
+		REFERENCES organizations (organization_id),
+	PRIMARY KEY(organization_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS organization_users (
+	organization_id bigint unsigned NOT NULL,
+	user_id bigint unsigned NOT NULL,
+	role bigint unsigned NOT NULL,
+	created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX(user_id),
+	CONSTRAINT organization_users_fk1 FOREIGN KEY (organization_id)
+		REFERENCES organizations (organization_id) ON DELETE CASCADE,
+	CONSTRAINT organization_users_fk2 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	CONSTRAINT organization_users_fk3 FOREIGN KEY (role)
+		REFERENCES roles (role_id),
+	PRIMARY KEY(organization_id, user_id)
+) ENGINE=InnoDB CHARSET=utf8;
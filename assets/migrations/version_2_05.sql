@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_erasures (
+	erasure_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	requested_by bigint unsigned NOT NULL,
+	mode varchar(16) NOT NULL,
+	reason varchar(512) NOT NULL DEFAULT '',
+	rows_removed bigint unsigned NOT NULL DEFAULT 0,
+	created_on datetime NOT NULL,
+	INDEX(user_id),
+	PRIMARY KEY(erasure_id)
+) ENGINE=InnoDB CHARSET=utf8;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS user_impersonations (
+	impersonation_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	actor_id bigint unsigned NOT NULL,
+	user_id bigint unsigned NOT NULL,
+	token_id varchar(64) NOT NULL,
+	reason varchar(512) NOT NULL,
+	expires_on datetime NOT NULL,
+	ended_on datetime NULL,
+	created_on datetime NOT NULL,
+	UNIQUE(token_id),
+	INDEX(actor_id),
+	INDEX(user_id),
+	PRIMARY KEY(impersonation_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS impersonation_requests (
+	impersonation_request_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	impersonation_id bigint unsigned NOT NULL,
+	method varchar(10) NOT NULL,
+	path varchar(512) NOT NULL,
+	created_on datetime NOT NULL,
+	CONSTRAINT impersonation_requests_fk1 FOREIGN KEY (impersonation_id)
+		REFERENCES user_impersonations (impersonation_id) ON DELETE CASCADE,
+	PRIMARY KEY(impersonation_request_id)
+) ENGINE=InnoDB CHARSET=utf8;
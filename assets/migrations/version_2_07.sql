@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS login_links (
+	login_link_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	token_hash char(64) NOT NULL,
+	expires_on datetime NOT NULL,
+	used_on datetime NULL,
+	created_on datetime NOT NULL,
+	UNIQUE(token_hash),
+	INDEX(user_id),
+	CONSTRAINT login_links_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(login_link_id)
+) ENGINE=InnoDB CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS login_link_requests (
+	login_link_request_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	email varchar(255) NOT NULL,
+	ip varchar(64) NOT NULL,
+	created_on datetime NOT NULL,
+	INDEX(email, created_on),
+	INDEX(ip, created_on),
+	PRIMARY KEY(login_link_request_id)
+) ENGINE=InnoDB CHARSET=utf8;
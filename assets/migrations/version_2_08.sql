@@ -0,0 +1 @@
+ALTER TABLE oidc_logins ADD COLUMN binding_hash char(64) NOT NULL DEFAULT '' AFTER state_hash;
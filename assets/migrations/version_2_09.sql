@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS mfa_attempts (
+	mfa_attempt_id bigint unsigned NOT NULL AUTO_INCREMENT,
+	user_id bigint unsigned NOT NULL,
+	success boolean NOT NULL,
+	created_on datetime NOT NULL,
+	INDEX(user_id, created_on),
+	CONSTRAINT mfa_attempts_fk1 FOREIGN KEY (user_id)
+		REFERENCES users (user_id) ON DELETE CASCADE,
+	PRIMARY KEY(mfa_attempt_id)
+) ENGINE=InnoDB CHARSET=utf8;
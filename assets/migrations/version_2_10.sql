@@ -0,0 +1 @@
+ALTER TABLE user_token_revocations MODIFY revoked_before datetime(6) NOT NULL;
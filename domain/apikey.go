@@ -0,0 +1,207 @@
+package domain
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// apiKeyPrefix starts every api key so they are recognizable in logs and config files
+const apiKeyPrefix = "rk"
+
+// ErrInvalidAPIKey is an unknown, expired or revoked api key error
+var ErrInvalidAPIKey = fmt.Errorf("Invalid API key")
+
+// ErrAPIKeyUserInactive is returned when a key would act as a deleted or
+// inactive user
+var ErrAPIKeyUserInactive = fmt.Errorf("API keys may only act as active users")
+
+// APIKey is a credential for external processes. The key acts as UserID
+// and may only access routes that declare scopes, all of which the key holds
+type APIKey struct {
+	APIKeyID   int64       `db:"api_key_id" json:"api_key_id"`
+	UserID     int64       `db:"user_id" json:"user_id"`
+	Name       string      `db:"name" json:"name"`
+	Prefix     string      `db:"prefix" json:"prefix"`
+	KeyHash    string      `db:"key_hash" json:"-"`
+	ScopesStr  string      `db:"scopes" json:"-"`
+	Scopes     []string    `db:"-" json:"scopes"`
+	ExpiresOn  db.NullTime `db:"expires_on" json:"expires_on"`
+	RevokedOn  db.NullTime `db:"revoked_on" json:"revoked_on"`
+	LastUsedOn db.NullTime `db:"last_used_on" json:"last_used_on"`
+	CreatedBy  int64       `db:"created_by" json:"created_by"`
+	CreatedOn  time.Time   `db:"created_on" json:"created_on"`
+	Key        string      `db:"-" json:"key,omitempty"` // only set on creation
+}
+
+// HasScopes returns true if the key holds every scope
+func (k APIKey) HasScopes(scopes ...string) bool {
+	for _, s := range scopes {
+		found := false
+		for _, ks := range k.Scopes {
+			if s == ks {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateAPIKey creates a new api key acting as userid. createdBy must hold
+// every permission userid has. The plain key is only available on the
+// returned APIKey and is never stored
+func CreateAPIKey(qe db.QueryExecer, createdBy, userid int64, name string, scopes []string, expires *time.Time) (*APIKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name required")
+	}
+	clean := []string{}
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		if s == "" || strings.Contains(s, ",") {
+			return nil, fmt.Errorf("invalid scope %q", s)
+		}
+		clean = append(clean, s)
+	}
+	if len(clean) == 0 {
+		return nil, fmt.Errorf("at least one scope required")
+	}
+	usr, err := GetUserWithID(qe, userid)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted || usr.Status != StatusActive {
+		return nil, ErrAPIKeyUserInactive
+	}
+	if err := CheckManageable(qe, createdBy, userid); err != nil {
+		return nil, err
+	}
+
+	pb := make([]byte, 4)
+	if _, err := rand.Read(pb); err != nil {
+		return nil, err
+	}
+	prefix := hex.EncodeToString(pb)
+	secret, err := token.Random(32)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s_%s_%s", apiKeyPrefix, prefix, secret)
+
+	k := APIKey{
+		UserID:    userid,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   token.Hash(key),
+		ScopesStr: strings.Join(clean, ","),
+		Scopes:    clean,
+		CreatedBy: createdBy,
+		CreatedOn: time.Now(),
+		Key:       key,
+	}
+	if expires != nil {
+		k.ExpiresOn = db.NewNullTime(*expires)
+	}
+	str := `
+	INSERT INTO api_keys
+		(user_id, name, prefix, key_hash, scopes, expires_on, created_by)
+		VALUES
+		(:user_id, :name, :prefix, :key_hash, :scopes, :expires_on, :created_by)
+	`
+	resp, err := qe.NamedExec(str, &k)
+	if err != nil {
+		return nil, err
+	}
+	k.APIKeyID, err = resp.LastInsertId()
+	return &k, err
+}
+
+// AuthenticateAPIKey returns the api key if it is valid and its user is
+// active. Last used writes are throttled to one every apiKeyTouchInterval
+func AuthenticateAPIKey(st db.Storer, key string) (*APIKey, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, ErrInvalidAPIKey
+	}
+	k, err := getAPIKeyWithPrefix(st, parts[1])
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(token.Hash(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if k.RevokedOn.Valid || (k.ExpiresOn.Valid && now.After(k.ExpiresOn.Time)) {
+		return nil, ErrInvalidAPIKey
+	}
+	// keys stop working with their user, even before they are revoked
+	var status UserStatus
+	str := "SELECT status FROM users WHERE user_id = ? AND deleted = false"
+	if err := st.Get(&status, str, k.UserID); err != nil || status != StatusActive {
+		return nil, ErrInvalidAPIKey
+	}
+	if k.LastUsedOn.Valid && now.Sub(k.LastUsedOn.Time) < apiKeyTouchInterval {
+		return k, nil
+	}
+	str = "UPDATE api_keys SET last_used_on = ? WHERE api_key_id = ? AND (last_used_on IS NULL OR last_used_on < ?)"
+	if _, err := st.Exec(str, now, k.APIKeyID, now.Add(-apiKeyTouchInterval)); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// GetAPIKeys returns all api keys
+func GetAPIKeys(qr db.Queryer) ([]APIKey, error) {
+	str := "SELECT * FROM api_keys ORDER BY api_key_id"
+	keys := []APIKey{}
+	if err := qr.Select(&keys, str); err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i].Scopes = splitScopes(keys[i].ScopesStr)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey will revoke an api key
+func RevokeAPIKey(ex db.Execer, keyid int64) error {
+	str := "UPDATE api_keys SET revoked_on = ? WHERE api_key_id = ? AND revoked_on IS NULL"
+	_, err := ex.Exec(str, time.Now(), keyid)
+	return err
+}
+
+func getAPIKeyWithPrefix(qr db.Queryer, prefix string) (*APIKey, error) {
+	str := "SELECT * FROM api_keys WHERE prefix = ?"
+	k := APIKey{}
+	if err := qr.Get(&k, str, prefix); err != nil {
+		return nil, err
+	}
+	k.Scopes = splitScopes(k.ScopesStr)
+	return &k, nil
+}
+
+func splitScopes(str string) []string {
+	scopes := []string{}
+	for _, s := range strings.Split(str, ",") {
+		if s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// revokeUserAPIKeys will revoke every api key acting as a user
+func revokeUserAPIKeys(ex db.Execer, userid int64) error {
+	str := "UPDATE api_keys SET revoked_on = ? WHERE user_id = ? AND revoked_on IS NULL"
+	_, err := ex.Exec(str, time.Now(), userid)
+	return err
+}
@@ -0,0 +1,123 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+const defConfPath = "/etc/radica/account.json"
+
+// Unverified user policies
+const (
+	VerifyPolicyAllow      = "allow"      // unverified users may use every route
+	VerifyPolicyRestricted = "restricted" // unverified users may only use routes marked AllowUnverified
+	VerifyPolicyDeny       = "deny"       // unverified users may not login
+)
+
+var localConf = defaultConfig()
+
+type config struct {
+	Verification   verificationConfig  `json:"verification"`
+	PasswordReset  passwordResetConfig `json:"password_reset"`
+	PasswordPolicy PasswordPolicy      `json:"password_policy"`
+	Invite         inviteConfig        `json:"invite"`
+	LoginLink      loginLinkConfig     `json:"login_link"`
+}
+
+type verificationConfig struct {
+	Policy      string `json:"policy"`
+	URL         string `json:"url"` // the verification token is appended as ?t=
+	ExpireHours int    `json:"expire_hours"`
+	Secret      string `json:"secret"` // signs verification links, derived from the jwt secret when empty
+}
+
+type passwordResetConfig struct {
+	URL           string `json:"url"` // the reset token is appended as ?t=
+	ExpireMinutes int    `json:"expire_minutes"`
+}
+
+type inviteConfig struct {
+	URL    string `json:"url"`    // the invite token is appended as ?t=
+	Secret string `json:"secret"` // signs invite links, derived from the jwt secret when empty
+}
+
+type loginLinkConfig struct {
+	URL           string `json:"url"` // the login token is appended as ?t=
+	ExpireMinutes int    `json:"expire_minutes"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Verification: verificationConfig{
+			Policy:      VerifyPolicyRestricted,
+			ExpireHours: 48,
+		},
+		PasswordReset: passwordResetConfig{
+			ExpireMinutes: 30,
+		},
+		LoginLink: loginLinkConfig{
+			ExpireMinutes: 15,
+		},
+		PasswordPolicy: PasswordPolicy{
+			MinLength:      8,
+			MaxLength:      64,
+			RequireUpper:   true,
+			RequireLower:   true,
+			RequireNumber:  true,
+			RequireSpecial: true,
+			History:        5,
+			ForbidUserInfo: true,
+		},
+	}
+}
+
+// Configure will configure account policies using the defConfPath.
+// Until it is called, or if it fails, the defaults are used
+func Configure() error {
+	f, err := os.Open(defConfPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conf := defaultConfig()
+	if err := json.NewDecoder(f).Decode(conf); err != nil {
+		return err
+	}
+	switch conf.Verification.Policy {
+	case VerifyPolicyAllow, VerifyPolicyRestricted, VerifyPolicyDeny:
+	default:
+		return fmt.Errorf("unknown verification policy %q", conf.Verification.Policy)
+	}
+	if conf.Verification.ExpireHours < 1 {
+		return fmt.Errorf("verification expire_hours must be greater than zero")
+	}
+	if conf.PasswordReset.ExpireMinutes < 1 {
+		return fmt.Errorf("password_reset expire_minutes must be greater than zero")
+	}
+	if conf.LoginLink.ExpireMinutes < 1 {
+		return fmt.Errorf("login_link expire_minutes must be greater than zero")
+	}
+	if pp := conf.PasswordPolicy; pp.MinLength < 1 || (pp.MaxLength > 0 && pp.MaxLength < pp.MinLength) {
+		return fmt.Errorf("password_policy lengths are invalid")
+	}
+	localConf = conf
+	return nil
+}
+
+// signingKey returns secret, or a key for purpose derived from the jwt secret
+// when none is configured
+func signingKey(secret, purpose string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	return token.DeriveKey(purpose)
+}
+
+// UnverifiedPolicy returns the policy for users who have not verified their email
+func UnverifiedPolicy() string {
+	return localConf.Verification.Policy
+}
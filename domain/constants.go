@@ -1,18 +1,70 @@
 package domain
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 // templates
 const defTemplatePath = "/etc/radica/templates"
 
 // invites
 const (
-	inviteKey      = "freak-lord-angles"
+	invitePurpose  = "invite" // derives the invite signing key
 	inviteExpHours = 48
 )
 
-// password reset
-const resetKey = "beatle-franklin-desk"
+// verifyPurpose derives the email verification signing key
+const verifyPurpose = "email verification"
+
+// two factor authentication
+const (
+	mfaIssuer            = "Radica"
+	recoveryCodeCount    = 10
+	mfaWindow            = 15 * time.Minute // failed codes older than this are forgotten
+	mfaChallengeAttempts = 5                // failed codes before a login challenge is discarded
+	mfaLockAttempts      = 10               // failed codes for a user before the account is locked
+)
+
+// oidcLoginTTL is how long a user has to complete a login with an identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// impersonationTTL is the lifetime of an impersonation token
+const impersonationTTL = 15 * time.Minute
+
+// sessionTouchInterval is how often a session's last seen time is written
+const sessionTouchInterval = time.Minute
+
+// apiKeyTouchInterval is how often an api key's last used time is written
+const apiKeyTouchInterval = time.Minute
+
+// user directory paging
+const (
+	defUserListLimit = 50
+	maxUserListLimit = 200
+)
+
+// maxOrgDepth limits how many levels of organizations are walked
+const maxOrgDepth = 10
+
+// login throttling
+const (
+	loginWindow       = 15 * time.Minute // failures older than this are forgotten
+	loginFreeAttempts = 3                // failures before delays start
+	loginBaseDelay    = time.Second      // doubled for each failure after loginFreeAttempts
+	loginMaxDelay     = 5 * time.Minute
+	loginLockAttempts = 10 // failures for an email before it is locked
+	loginLockDuration = 30 * time.Minute
+	loginIPAttempts   = 50 // failures from an ip before it is throttled
+)
+
+// login link throttling
+const (
+	loginLinkWindow        = 15 * time.Minute
+	loginLinkEmailRequests = 3  // links sent to an email per window, further requests are silently dropped
+	loginLinkIPRequests    = 20 // requests from an ip per window before it is throttled
+)
 
 // ErrDuplicateName is a duplicate name error
 var ErrDuplicateName = fmt.Errorf("Duplicate name")
@@ -63,6 +115,17 @@ func (s UserStatus) String() string {
 	return "Unknown"
 }
 
-//password related constant
-const minPassLength = 8
-const maxPassLength = 64
+// MarshalText returns the status name
+func (s UserStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseUserStatus returns the status with name, ignoring case
+func ParseUserStatus(name string) (UserStatus, error) {
+	for _, s := range []UserStatus{StatusInvited, StatusActive, StatusDeleted} {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", name)
+}
@@ -0,0 +1,152 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrCannotImpersonate is returned when the actor may not impersonate the user
+var ErrCannotImpersonate = fmt.Errorf("User may not be impersonated")
+
+// ErrImpersonationEnded is returned for an ended or unknown impersonation
+var ErrImpersonationEnded = fmt.Errorf("Impersonation has ended")
+
+// ErrReasonRequired is returned when an impersonation has no reason
+var ErrReasonRequired = fmt.Errorf("A reason is required")
+
+// Impersonation is an admin acting as a user. Every request made with its
+// token is recorded as an ImpersonationRequest
+type Impersonation struct {
+	ImpersonationID int64       `db:"impersonation_id" json:"impersonation_id"`
+	ActorID         int64       `db:"actor_id" json:"actor_id"`
+	UserID          int64       `db:"user_id" json:"user_id"`
+	TokenID         string      `db:"token_id" json:"-"`
+	Reason          string      `db:"reason" json:"reason"`
+	ExpiresOn       time.Time   `db:"expires_on" json:"expires_on"`
+	EndedOn         db.NullTime `db:"ended_on" json:"ended_on"`
+	CreatedOn       time.Time   `db:"created_on" json:"created_on"`
+	Token           string      `db:"-" json:"token,omitempty"` // only set on start
+	ExpiresIn       int64       `db:"-" json:"expires_in,omitempty"`
+}
+
+// ImpersonationRequest is a request made while impersonating
+type ImpersonationRequest struct {
+	ImpersonationRequestID int64     `db:"impersonation_request_id" json:"impersonation_request_id"`
+	ImpersonationID        int64     `db:"impersonation_id" json:"impersonation_id"`
+	Method                 string    `db:"method" json:"method"`
+	Path                   string    `db:"path" json:"path"`
+	CreatedOn              time.Time `db:"created_on" json:"created_on"`
+}
+
+// StartImpersonation issues a short lived token for actorid to act as
+// userid. The actor must hold every permission the user has and give a reason
+func StartImpersonation(qe db.QueryExecer, actorid, userid int64, reason string) (*Impersonation, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, ErrReasonRequired
+	}
+	if actorid == userid {
+		return nil, ErrCannotImpersonate
+	}
+	usr, err := GetUserWithID(qe, userid)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted || usr.Status != StatusActive {
+		return nil, ErrCannotImpersonate
+	}
+	have, err := GetUserPermissions(qe, actorid)
+	if err != nil {
+		return nil, err
+	}
+	need, err := GetUserPermissions(qe, userid)
+	if err != nil {
+		return nil, err
+	}
+	if !HasPermissions(have, need...) {
+		return nil, ErrCannotImpersonate
+	}
+
+	tok, jti, err := token.NewImpersonation(userid, actorid, impersonationTTL)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	imp := Impersonation{
+		ActorID:   actorid,
+		UserID:    userid,
+		TokenID:   jti,
+		Reason:    reason,
+		ExpiresOn: now.Add(impersonationTTL),
+		CreatedOn: now,
+	}
+	str := `
+	INSERT INTO user_impersonations
+		(actor_id, user_id, token_id, reason, expires_on, created_on)
+		VALUES
+		(:actor_id, :user_id, :token_id, :reason, :expires_on, :created_on)
+	`
+	resp, err := qe.NamedExec(str, &imp)
+	if err != nil {
+		return nil, err
+	}
+	if imp.ImpersonationID, err = resp.LastInsertId(); err != nil {
+		return nil, err
+	}
+	imp.Token = tok
+	imp.ExpiresIn = int64(impersonationTTL.Seconds())
+	return &imp, nil
+}
+
+// EndImpersonation ends an impersonation and revokes its token
+func EndImpersonation(ex db.Execer, claims *token.Claims) error {
+	str := "UPDATE user_impersonations SET ended_on = ? WHERE token_id = ? AND ended_on IS NULL"
+	if _, err := ex.Exec(str, time.Now(), claims.Id); err != nil {
+		return err
+	}
+	return token.Revoke(ex, claims)
+}
+
+// RecordImpersonatedRequest adds a request to the audit trail of the
+// impersonation with tokenid. It returns ErrImpersonationEnded if the
+// impersonation is not active
+func RecordImpersonatedRequest(ex db.Execer, tokenid, method, path string) error {
+	now := time.Now()
+	str := `
+	INSERT INTO impersonation_requests
+		(impersonation_id, method, path, created_on)
+	SELECT impersonation_id, ?, ?, ?
+	FROM user_impersonations
+	WHERE token_id = ?
+	AND ended_on IS NULL
+	AND expires_on > ?
+	`
+	res, err := ex.Exec(str, method, path, now, tokenid, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrImpersonationEnded
+	}
+	return nil
+}
+
+// GetImpersonations returns impersonations, newest first
+func GetImpersonations(qr db.Queryer) ([]Impersonation, error) {
+	str := "SELECT * FROM user_impersonations ORDER BY impersonation_id DESC"
+	imps := []Impersonation{}
+	err := qr.Select(&imps, str)
+	return imps, err
+}
+
+// GetImpersonationRequests returns the requests made during an impersonation
+func GetImpersonationRequests(qr db.Queryer, impersonationid int64) ([]ImpersonationRequest, error) {
+	str := "SELECT * FROM impersonation_requests WHERE impersonation_id = ? ORDER BY impersonation_request_id"
+	reqs := []ImpersonationRequest{}
+	err := qr.Select(&reqs, str, impersonationid)
+	return reqs, err
+}
@@ -0,0 +1,291 @@
+package domain
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/smtp"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrInvalidInvite is an unknown, expired, cancelled or accepted invite error
+var ErrInvalidInvite = fmt.Errorf("Invalid or expired invite")
+
+// Invite is an invitation for a pending user to set a password.
+// Resending replaces the nonce so earlier links stop working
+type Invite struct {
+	InviteID    int64        `db:"invite_id" json:"invite_id"`
+	UserID      db.NullInt64 `db:"user_id" json:"user_id"`
+	Email       string       `db:"email" json:"email"`
+	InvitedBy   int64        `db:"invited_by" json:"invited_by"`
+	Nonce       string       `db:"nonce" json:"-"`
+	SentOn      time.Time    `db:"sent_on" json:"sent_on"`
+	ExpiresOn   time.Time    `db:"expires_on" json:"expires_on"`
+	AcceptedOn  db.NullTime  `db:"accepted_on" json:"accepted_on"`
+	CancelledOn db.NullTime  `db:"cancelled_on" json:"cancelled_on"`
+	CreatedOn   time.Time    `db:"created_on" json:"created_on"`
+}
+
+// InviteUser creates a pending user with roles and emails them an invite.
+// invitedBy may only grant roles whose permissions they hold
+func InviteUser(st db.Storer, invitedBy int64, fn, ln, email string, roles ...int64) (*Invite, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return nil, fmt.Errorf("email required")
+	}
+	if IsUserExist(st, email) {
+		return nil, ErrDuplicateEmail
+	}
+	if len(roles) == 0 {
+		roles = []int64{RoleUser}
+	}
+	if err := checkGrantable(st, invitedBy, roles...); err != nil {
+		return nil, err
+	}
+	nonce, err := token.Random(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	u := NewUser(fn, ln, email)
+	u.Status = StatusInvited
+	str := `
+	INSERT INTO users
+		(first_name, last_name, email, status)
+		VALUES
+		(:first_name, :last_name, :email, :status)
+	`
+	resp, err := tx.NamedExec(str, u)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if u.UserID, err = resp.LastInsertId(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := AddUserRoles(tx, u.UserID, roles...); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now()
+	inv := Invite{
+		UserID:    db.NewNullInt64(u.UserID),
+		Email:     email,
+		InvitedBy: invitedBy,
+		Nonce:     nonce,
+		SentOn:    now,
+		ExpiresOn: now.Add(inviteExpHours * time.Hour),
+		CreatedOn: now,
+	}
+	str = `
+	INSERT INTO user_invites
+		(user_id, email, invited_by, nonce, sent_on, expires_on, created_on)
+		VALUES
+		(:user_id, :email, :invited_by, :nonce, :sent_on, :expires_on, :created_on)
+	`
+	resp, err = tx.NamedExec(str, &inv)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if inv.InviteID, err = resp.LastInsertId(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &inv, sendInvite(st, &inv)
+}
+
+// GetPendingInvites returns invites that have not been accepted or cancelled
+func GetPendingInvites(qr db.Queryer) ([]Invite, error) {
+	str := `
+	SELECT * FROM user_invites
+	WHERE accepted_on IS NULL
+	AND cancelled_on IS NULL
+	ORDER BY sent_on DESC
+	`
+	invites := []Invite{}
+	err := qr.Select(&invites, str)
+	return invites, err
+}
+
+// ResendInvite sends a new invite link with a new expiry. Earlier links stop working
+func ResendInvite(st db.Storer, inviteid int64) error {
+	inv, err := getPendingInvite(st, inviteid)
+	if err != nil {
+		return err
+	}
+	if inv.Nonce, err = token.Random(16); err != nil {
+		return err
+	}
+	now := time.Now()
+	inv.SentOn = now
+	inv.ExpiresOn = now.Add(inviteExpHours * time.Hour)
+	str := `
+	UPDATE user_invites
+	SET nonce = :nonce, sent_on = :sent_on, expires_on = :expires_on
+	WHERE invite_id = :invite_id
+	`
+	if _, err := st.NamedExec(str, inv); err != nil {
+		return err
+	}
+	return sendInvite(st, inv)
+}
+
+// CancelInvite cancels a pending invite and removes the pending user
+func CancelInvite(st db.Storer, inviteid int64) error {
+	inv, err := getPendingInvite(st, inviteid)
+	if err != nil {
+		return err
+	}
+	tx, err := st.Beginx()
+	if err != nil {
+		return err
+	}
+	str := "UPDATE user_invites SET cancelled_on = ? WHERE invite_id = ?"
+	if _, err := tx.Exec(str, time.Now(), inviteid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if inv.UserID.Valid {
+		str = "DELETE FROM users WHERE user_id = ? AND status = ?"
+		if _, err := tx.Exec(str, inv.UserID.Int64, StatusInvited); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AcceptInvite sets the invited user's password and activates them. The
+// password must meet the password policy
+func AcceptInvite(st db.Storer, tok, pass string) (*User, error) {
+	key, err := signingKey(localConf.Invite.Secret, invitePurpose)
+	if err != nil {
+		return nil, err
+	}
+	val, err := verifySignedToken(tok, key)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidInvite
+	}
+	inviteid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	inv, err := getPendingInvite(st, inviteid)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Nonce != parts[1] || !inv.UserID.Valid {
+		return nil, ErrInvalidInvite
+	}
+	userid := inv.UserID.Int64
+	if err := CheckPassword(st, userid, pass); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	str := "UPDATE user_invites SET accepted_on = ? WHERE invite_id = ? AND accepted_on IS NULL AND cancelled_on IS NULL"
+	res, err := tx.Exec(str, now, inviteid)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		_ = tx.Rollback()
+		return nil, ErrInvalidInvite
+	}
+	if err := setPassword(tx, userid, pass); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	// following the link proves the invitee owns the email
+	str = "UPDATE users SET status = ?, email_verified_on = ? WHERE user_id = ?"
+	if _, err := tx.Exec(str, StatusActive, now, userid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetUserWithID(st, userid)
+}
+
+// getPendingInvite returns ErrInvalidInvite unless the invite is pending. The
+// signed link carries the expiry
+func getPendingInvite(qr db.Queryer, inviteid int64) (*Invite, error) {
+	inv := Invite{}
+	str := "SELECT * FROM user_invites WHERE invite_id = ?"
+	err := qr.Get(&inv, str, inviteid)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inv.AcceptedOn.Valid || inv.CancelledOn.Valid {
+		return nil, ErrInvalidInvite
+	}
+	return &inv, nil
+}
+
+// sendInvite emails a signed invite link
+func sendInvite(qr db.Queryer, inv *Invite) error {
+	iurl := localConf.Invite.URL
+	if iurl == "" {
+		return fmt.Errorf("invite url not configured")
+	}
+	key, err := signingKey(localConf.Invite.Secret, invitePurpose)
+	if err != nil {
+		return err
+	}
+	tok := genSignedToken(fmt.Sprintf("%v:%v", inv.InviteID, inv.Nonce), inv.ExpiresOn, key)
+	link := fmt.Sprintf("%s?t=%s", iurl, url.QueryEscape(tok))
+
+	inviter := "Someone"
+	if by, err := GetUserWithID(qr, inv.InvitedBy); err == nil {
+		if name := strings.TrimSpace(by.FirstName.String + " " + by.LastName.String); name != "" {
+			inviter = name
+		}
+	}
+
+	fname := fmt.Sprintf("%v/%v", defTemplatePath, "invite.html")
+	tmp, err := template.ParseFiles(fname)
+	if err != nil {
+		return err
+	}
+	p := struct {
+		Link    string
+		Inviter string
+		Hours   int
+	}{Link: link, Inviter: inviter, Hours: inviteExpHours}
+	var b bytes.Buffer
+	if err := tmp.Execute(&b, p); err != nil {
+		return err
+	}
+	mailer := smtp.SMTP{}
+	return mailer.Send("You have been invited to Radica", b.String(), nil, inv.Email)
+}
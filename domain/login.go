@@ -0,0 +1,234 @@
+package domain
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/password"
+)
+
+// LoginThrottledError is returned when a login is attempted too soon after failed attempts
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e LoginThrottledError) Error() string {
+	if e.Locked {
+		return "Account is temporarily locked"
+	}
+	return "Too many failed login attempts"
+}
+
+// AccountLock is a record of an account locked after failed logins
+type AccountLock struct {
+	AccountLockID int64        `db:"account_lock_id" json:"account_lock_id"`
+	UserID        int64        `db:"user_id" json:"user_id"`
+	Reason        string       `db:"reason" json:"reason"`
+	LockedOn      time.Time    `db:"locked_on" json:"locked_on"`
+	LockedUntil   time.Time    `db:"locked_until" json:"locked_until"`
+	UnlockedOn    db.NullTime  `db:"unlocked_on" json:"unlocked_on"`
+	UnlockedBy    db.NullInt64 `db:"unlocked_by" json:"unlocked_by"`
+}
+
+// Login authenticates a user. Repeated failures for an email are delayed and
+// then locked, repeated failures from an ip are throttled
+func Login(st db.Storer, email, pass, ip string) (*User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	now := time.Now()
+	if err := checkLogin(st, email, ip, now); err != nil {
+		return nil, err
+	}
+	usr, err := Authenticate(st, email, pass)
+	if rerr := recordLogin(st, email, ip, err == nil, now); rerr != nil {
+		return nil, rerr
+	}
+	return usr, err
+}
+
+// GetAccountLocks returns locks that have not expired or been unlocked
+func GetAccountLocks(qr db.Queryer) ([]AccountLock, error) {
+	str := `
+	SELECT * FROM account_locks
+	WHERE unlocked_on IS NULL
+	AND locked_until > ?
+	ORDER BY locked_on DESC
+	`
+	locks := []AccountLock{}
+	err := qr.Select(&locks, str, time.Now())
+	return locks, err
+}
+
+// UnlockAccount ends a user's active locks and forgives their failed logins
+func UnlockAccount(ex db.Execer, userid, unlockedBy int64) error {
+	now := time.Now()
+	str := `
+	UPDATE account_locks
+	SET unlocked_on = ?, unlocked_by = ?
+	WHERE user_id = ?
+	AND unlocked_on IS NULL
+	AND locked_until > ?
+	`
+	_, err := ex.Exec(str, now, unlockedBy, userid, now)
+	return err
+}
+
+func checkLogin(qr db.Queryer, email, ip string, now time.Time) error {
+	if err := checkLoginIP(qr, ip, now); err != nil {
+		return err
+	}
+	return checkLoginEmail(qr, email, now)
+}
+
+func checkLoginIP(qr db.Queryer, ip string, now time.Time) error {
+	str := `
+	SELECT count(*) FROM login_attempts
+	WHERE ip = ?
+	AND success = false
+	AND created_on > ?
+	`
+	cnt := 0
+	if err := qr.Get(&cnt, str, ip, now.Add(-loginWindow)); err != nil {
+		return err
+	}
+	if cnt >= loginIPAttempts {
+		return LoginThrottledError{RetryAfter: loginWindow}
+	}
+	return nil
+}
+
+func checkLoginEmail(qr db.Queryer, email string, now time.Time) error {
+	fails, err := recentFailures(qr, email, now)
+	if err != nil {
+		return err
+	}
+	if len(fails) == 0 {
+		return nil
+	}
+	last := fails[0]
+	if until := last.Add(loginLockDuration); len(fails) >= loginLockAttempts && now.Before(until) {
+		return LoginThrottledError{RetryAfter: until.Sub(now), Locked: true}
+	}
+
+	n := 0
+	for _, f := range fails {
+		if f.After(now.Add(-loginWindow)) {
+			n++
+		}
+	}
+	if n < loginFreeAttempts {
+		return nil
+	}
+	delay := loginBaseDelay << uint(n-loginFreeAttempts)
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+	if next := last.Add(delay); now.Before(next) {
+		return LoginThrottledError{RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
+
+// recentFailures returns up to loginLockAttempts failures for an email, newest
+// first. Failures before the last successful login or unlock are forgiven, as
+// are failures more than loginWindow before the newest one
+func recentFailures(qr db.Queryer, email string, now time.Time) ([]time.Time, error) {
+	since := now.Add(-loginWindow - loginLockDuration)
+	str := `
+	SELECT MAX(created_on) FROM login_attempts
+	WHERE email = ?
+	AND success = true
+	`
+	var ok db.NullTime
+	if err := qr.Get(&ok, str, email); err != nil {
+		return nil, err
+	}
+	if ok.Valid && ok.Time.After(since) {
+		since = ok.Time
+	}
+	str = `
+	SELECT MAX(al.unlocked_on) FROM account_locks al
+	INNER JOIN users u
+	ON u.user_id = al.user_id
+	WHERE u.email = ?
+	`
+	var unlocked db.NullTime
+	if err := qr.Get(&unlocked, str, email); err != nil {
+		return nil, err
+	}
+	if unlocked.Valid && unlocked.Time.After(since) {
+		since = unlocked.Time
+	}
+
+	str = `
+	SELECT created_on FROM login_attempts
+	WHERE email = ?
+	AND success = false
+	AND created_on > ?
+	ORDER BY created_on DESC
+	LIMIT ?
+	`
+	fails := []time.Time{}
+	if err := qr.Select(&fails, str, email, since, loginLockAttempts); err != nil {
+		return nil, err
+	}
+	for i, f := range fails {
+		if f.Before(fails[0].Add(-loginWindow)) {
+			return fails[:i], nil
+		}
+	}
+	return fails, nil
+}
+
+func recordLogin(st db.Storer, email, ip string, success bool, now time.Time) error {
+	str := `
+	INSERT INTO login_attempts
+		(email, ip, success, created_on)
+		VALUES
+		(?, ?, ?, ?)
+	`
+	if _, err := st.Exec(str, email, ip, success, now); err != nil {
+		return err
+	}
+	if success {
+		return nil
+	}
+
+	// Record the lock for admins if this failure locked a real account
+	err := checkLoginEmail(st, email, now)
+	if te, ok := err.(LoginThrottledError); !ok || !te.Locked {
+		return nil
+	}
+	uid, err := GetUserID(st, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	str = `
+	INSERT INTO account_locks
+		(user_id, reason, locked_on, locked_until)
+		VALUES
+		(?, ?, ?, ?)
+	`
+	_, err = st.Exec(str, uid, "Too many failed logins", now, now.Add(loginLockDuration))
+	return err
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// compareDummy spends the same time as checking a real password so unknown
+// emails can not be detected by timing
+func compareDummy(pass string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = password.Hash("not-a-real-password")
+	})
+	_ = password.Compare(dummyHash, pass)
+}
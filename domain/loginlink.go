@@ -0,0 +1,178 @@
+package domain
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/smtp"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrInvalidLoginLink is an unknown, expired or used login link error
+var ErrInvalidLoginLink = fmt.Errorf("Invalid or expired login link")
+
+// LoginLink is a single use passwordless login token. Only the hash of the
+// token is stored
+type LoginLink struct {
+	LoginLinkID int64       `db:"login_link_id" json:"login_link_id"`
+	UserID      int64       `db:"user_id" json:"user_id"`
+	TokenHash   string      `db:"token_hash" json:"-"`
+	ExpiresOn   time.Time   `db:"expires_on" json:"expires_on"`
+	UsedOn      db.NullTime `db:"used_on" json:"used_on"`
+	CreatedOn   time.Time   `db:"created_on" json:"created_on"`
+}
+
+// SendLoginLink will email a user a single use sign in link. Earlier links
+// are invalidated. An ip making too many requests is throttled. Unknown,
+// deleted and invited emails, and emails sent too many links, are ignored so
+// callers can not discover accounts. Everything that depends on the email
+// belonging to a user happens in the background and failures are logged, so
+// the call takes as long either way. st must not be a transaction
+func SendLoginLink(st db.Storer, email, ip string) error {
+	conf := localConf.LoginLink
+	if conf.URL == "" {
+		return fmt.Errorf("login link url not configured")
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	now := time.Now()
+	since := now.Add(-loginLinkWindow)
+
+	str := "SELECT count(*) FROM login_link_requests WHERE ip = ? AND created_on > ?"
+	cnt := 0
+	if err := st.Get(&cnt, str, ip, since); err != nil {
+		return err
+	}
+	if cnt >= loginLinkIPRequests {
+		return LoginThrottledError{RetryAfter: loginLinkWindow}
+	}
+	str = "SELECT count(*) FROM login_link_requests WHERE email = ? AND created_on > ?"
+	if err := st.Get(&cnt, str, email, since); err != nil {
+		return err
+	}
+	str = `
+	INSERT INTO login_link_requests
+		(email, ip, created_on)
+		VALUES
+		(?, ?, ?)
+	`
+	if _, err := st.Exec(str, email, ip, now); err != nil {
+		return err
+	}
+	if cnt >= loginLinkEmailRequests {
+		return nil
+	}
+	go func() {
+		if err := sendLoginLink(st, email, now); err != nil {
+			logger.Errorf("sendLoginLink %v", err)
+		}
+	}()
+	return nil
+}
+
+// sendLoginLink emails the link if email belongs to an active user
+func sendLoginLink(st db.Storer, email string, now time.Time) error {
+	conf := localConf.LoginLink
+	usr, err := GetUserWithEmail(st, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if usr.Deleted || usr.Status != StatusActive {
+		return nil
+	}
+
+	tok, err := token.Random(32)
+	if err != nil {
+		return err
+	}
+	str := "UPDATE login_links SET used_on = ? WHERE user_id = ? AND used_on IS NULL"
+	if _, err := st.Exec(str, now, usr.UserID); err != nil {
+		return err
+	}
+	str = `
+	INSERT INTO login_links
+		(user_id, token_hash, expires_on, created_on)
+		VALUES
+		(?, ?, ?, ?)
+	`
+	exp := now.Add(time.Duration(conf.ExpireMinutes) * time.Minute)
+	if _, err := st.Exec(str, usr.UserID, token.Hash(tok), exp, now); err != nil {
+		return err
+	}
+
+	lurl := fmt.Sprintf("%s?t=%s", conf.URL, url.QueryEscape(tok))
+	fname := fmt.Sprintf("%v/%v", defTemplatePath, "loginlink.html")
+	tmp, err := template.ParseFiles(fname)
+	if err != nil {
+		return err
+	}
+	p := struct {
+		Link    string
+		Minutes int
+	}{Link: lurl, Minutes: conf.ExpireMinutes}
+	var b bytes.Buffer
+	if err := tmp.Execute(&b, p); err != nil {
+		return err
+	}
+	mailer := smtp.SMTP{}
+	return mailer.Send("Sign in to Radica", b.String(), nil, usr.Email)
+}
+
+// RedeemLoginLink uses up a login link and returns its user. As the user
+// proved they own the email, it is marked verified
+func RedeemLoginLink(st db.Storer, tok string) (*User, error) {
+	ll := LoginLink{}
+	str := "SELECT * FROM login_links WHERE token_hash = ?"
+	err := st.Get(&ll, str, token.Hash(tok))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidLoginLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if ll.UsedOn.Valid || now.After(ll.ExpiresOn) {
+		return nil, ErrInvalidLoginLink
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	str = "UPDATE login_links SET used_on = ? WHERE login_link_id = ? AND used_on IS NULL"
+	res, err := tx.Exec(str, now, ll.LoginLinkID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		_ = tx.Rollback()
+		return nil, ErrInvalidLoginLink
+	}
+	str = "UPDATE users SET email_verified_on = ? WHERE user_id = ? AND email_verified_on IS NULL"
+	if _, err := tx.Exec(str, now, ll.UserID); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	usr, err := GetUserWithID(st, ll.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted {
+		return nil, ErrUserDeleted
+	}
+	return usr, nil
+}
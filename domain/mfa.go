@@ -0,0 +1,356 @@
+package domain
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+	"github.com/rajendraventurit/radicaapi/lib/totp"
+)
+
+// ErrMFAEnabled is returned when enrolling a user who already has mfa enabled
+var ErrMFAEnabled = fmt.Errorf("Two factor authentication is already enabled")
+
+// ErrMFANotEnabled is returned when mfa is required but not enabled
+var ErrMFANotEnabled = fmt.Errorf("Two factor authentication is not enabled")
+
+// ErrInvalidMFACode is an invalid, expired or reused code error
+var ErrInvalidMFACode = fmt.Errorf("Invalid two factor code")
+
+// ErrMFAChallengeFailed is returned when a login challenge has had too many
+// invalid codes, the user must log in again
+var ErrMFAChallengeFailed = fmt.Errorf("Too many invalid two factor codes, please log in again")
+
+// MFA is a user's TOTP enrollment
+type MFA struct {
+	UserID      int64       `db:"user_id" json:"user_id"`
+	Secret      string      `db:"secret" json:"-"`
+	Enabled     bool        `db:"enabled" json:"enabled"`
+	LastStep    int64       `db:"last_step" json:"-"` // last accepted time step, prevents replay
+	ConfirmedOn db.NullTime `db:"confirmed_on" json:"confirmed_on"`
+	CreatedOn   time.Time   `db:"created_on" json:"created_on"`
+	UpdatedOn   time.Time   `db:"updated_on" json:"updated_on"`
+}
+
+// MFAEnrollment is returned when a user starts enrolling. URI is rendered
+// as a QR code for authenticator apps
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// EnrollMFA starts TOTP enrollment for a user. It is not enabled until
+// confirmed with ConfirmMFA
+func EnrollMFA(st db.Storer, usr *User) (*MFAEnrollment, error) {
+	m, err := getMFA(st, usr.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && m.Enabled {
+		return nil, ErrMFAEnabled
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	str := `
+	INSERT INTO user_mfa
+		(user_id, secret, enabled, last_step)
+		VALUES
+		(?, ?, false, 0)
+	ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_step = 0
+	`
+	if _, err := st.Exec(str, usr.UserID, secret); err != nil {
+		return nil, err
+	}
+	return &MFAEnrollment{Secret: secret, URI: totp.URI(mfaIssuer, usr.Email, secret)}, nil
+}
+
+// ConfirmMFA enables mfa once the user proves they can generate codes.
+// It returns recovery codes, these are only available now
+func ConfirmMFA(st db.Storer, userid int64, code string) ([]string, error) {
+	m, err := getMFA(st, userid)
+	if err == sql.ErrNoRows {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Enabled {
+		return nil, ErrMFAEnabled
+	}
+	if err := useTOTPCode(st, m, code); err != nil {
+		return nil, err
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	str := "UPDATE user_mfa SET enabled = true, confirmed_on = ? WHERE user_id = ?"
+	if _, err := tx.Exec(str, time.Now(), userid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	codes, err := genRecoveryCodes(tx, userid)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableMFA turns off mfa, a valid code or recovery code is required.
+// Failures count towards locking the account as they do at login
+func DisableMFA(st db.Storer, userid int64, code string) error {
+	if err := verifyMFACounted(st, userid, code); err != nil {
+		return err
+	}
+	if _, err := st.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userid); err != nil {
+		return err
+	}
+	_, err := st.Exec("DELETE FROM user_mfa WHERE user_id = ?", userid)
+	return err
+}
+
+// MFAEnabled returns true if the user has confirmed mfa
+func MFAEnabled(qr db.Queryer, userid int64) (bool, error) {
+	m, err := getMFA(qr, userid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return m.Enabled, nil
+}
+
+// VerifyMFA checks a TOTP code or a recovery code. Each may only be used once
+func VerifyMFA(st db.Storer, userid int64, code string) error {
+	m, err := getMFA(st, userid)
+	if err == sql.ErrNoRows {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if !m.Enabled {
+		return ErrMFANotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return useTOTPCode(st, m, code)
+	}
+	return useRecoveryCode(st, userid, code)
+}
+
+// VerifyMFALogin checks the code for a login challenge issued at issued.
+// Failures are recorded for the user. After mfaChallengeAttempts failures
+// since the challenge was issued ErrMFAChallengeFailed is returned and the
+// challenge must be discarded, after mfaLockAttempts failures the account is
+// locked until it expires or an admin unlocks it
+func VerifyMFALogin(st db.Storer, userid int64, issued time.Time, code string) error {
+	now := time.Now()
+	fails, err := checkMFAAttempts(st, userid, now)
+	if err != nil {
+		return err
+	}
+	if countSince(fails, issued) >= mfaChallengeAttempts {
+		return ErrMFAChallengeFailed
+	}
+	fails, err = verifyMFAAttempt(st, userid, code, fails, now)
+	if err == ErrInvalidMFACode && countSince(fails, issued) >= mfaChallengeAttempts {
+		return ErrMFAChallengeFailed
+	}
+	return err
+}
+
+// verifyMFACounted checks a code outside of a login challenge. Failures are
+// recorded and lock the account as they do for VerifyMFALogin
+func verifyMFACounted(st db.Storer, userid int64, code string) error {
+	now := time.Now()
+	fails, err := checkMFAAttempts(st, userid, now)
+	if err != nil {
+		return err
+	}
+	_, err = verifyMFAAttempt(st, userid, code, fails, now)
+	return err
+}
+
+// checkMFAAttempts returns a LoginThrottledError if the account is locked,
+// otherwise the user's recent failed codes
+func checkMFAAttempts(qr db.Queryer, userid int64, now time.Time) ([]time.Time, error) {
+	if err := checkAccountLock(qr, userid, now); err != nil {
+		return nil, err
+	}
+	return mfaFailures(qr, userid, now)
+}
+
+// verifyMFAAttempt checks a code and records the attempt. fails are the
+// user's recent failures, they are returned with this one if it failed. The
+// account is locked once there are mfaLockAttempts failures
+func verifyMFAAttempt(st db.Storer, userid int64, code string, fails []time.Time, now time.Time) ([]time.Time, error) {
+	verr := VerifyMFA(st, userid, code)
+	if verr != nil && verr != ErrInvalidMFACode {
+		return fails, verr
+	}
+	str := "INSERT INTO mfa_attempts (user_id, success, created_on) VALUES (?, ?, ?)"
+	if _, err := st.Exec(str, userid, verr == nil, now); err != nil {
+		return fails, err
+	}
+	if verr == nil {
+		return fails, nil
+	}
+
+	fails = append([]time.Time{now}, fails...)
+	if len(fails) >= mfaLockAttempts {
+		str = `
+		INSERT INTO account_locks
+			(user_id, reason, locked_on, locked_until)
+			VALUES
+			(?, ?, ?, ?)
+		`
+		if _, err := st.Exec(str, userid, "Too many failed two factor codes", now, now.Add(loginLockDuration)); err != nil {
+			return fails, err
+		}
+		return fails, LoginThrottledError{RetryAfter: loginLockDuration, Locked: true}
+	}
+	return fails, ErrInvalidMFACode
+}
+
+// checkAccountLock returns a LoginThrottledError if the user has an active
+// lock
+func checkAccountLock(qr db.Queryer, userid int64, now time.Time) error {
+	str := `
+	SELECT MAX(locked_until) FROM account_locks
+	WHERE user_id = ?
+	AND unlocked_on IS NULL
+	AND locked_until > ?
+	`
+	var until db.NullTime
+	if err := qr.Get(&until, str, userid, now); err != nil {
+		return err
+	}
+	if until.Valid {
+		return LoginThrottledError{RetryAfter: until.Time.Sub(now), Locked: true}
+	}
+	return nil
+}
+
+// mfaFailures returns the user's failed codes in the last mfaWindow, newest
+// first. Failures before a successful code or an unlock are forgiven
+func mfaFailures(qr db.Queryer, userid int64, now time.Time) ([]time.Time, error) {
+	since := now.Add(-mfaWindow)
+	str := "SELECT MAX(created_on) FROM mfa_attempts WHERE user_id = ? AND success = true"
+	var ok db.NullTime
+	if err := qr.Get(&ok, str, userid); err != nil {
+		return nil, err
+	}
+	if ok.Valid && ok.Time.After(since) {
+		since = ok.Time
+	}
+	str = "SELECT MAX(unlocked_on) FROM account_locks WHERE user_id = ?"
+	var unlocked db.NullTime
+	if err := qr.Get(&unlocked, str, userid); err != nil {
+		return nil, err
+	}
+	if unlocked.Valid && unlocked.Time.After(since) {
+		since = unlocked.Time
+	}
+	str = `
+	SELECT created_on FROM mfa_attempts
+	WHERE user_id = ?
+	AND success = false
+	AND created_on > ?
+	ORDER BY created_on DESC
+	LIMIT ?
+	`
+	fails := []time.Time{}
+	err := qr.Select(&fails, str, userid, since, mfaLockAttempts)
+	return fails, err
+}
+
+// countSince returns how many of times are not before t
+func countSince(times []time.Time, t time.Time) int {
+	n := 0
+	for _, tm := range times {
+		if !tm.Before(t) {
+			n++
+		}
+	}
+	return n
+}
+
+func useTOTPCode(ex db.Execer, m *MFA, code string) error {
+	step, ok := totp.Validate(m.Secret, code, time.Now())
+	if !ok || step <= m.LastStep {
+		return ErrInvalidMFACode
+	}
+	str := "UPDATE user_mfa SET last_step = ? WHERE user_id = ? AND last_step < ?"
+	res, err := ex.Exec(str, step, m.UserID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func useRecoveryCode(ex db.Execer, userid int64, code string) error {
+	str := `
+	UPDATE user_recovery_codes
+	SET used_on = ?
+	WHERE user_id = ?
+	AND code_hash = ?
+	AND used_on IS NULL
+	`
+	res, err := ex.Exec(str, time.Now(), userid, token.Hash(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// genRecoveryCodes replaces a user's recovery codes
+func genRecoveryCodes(ex db.Execer, userid int64) ([]string, error) {
+	if _, err := ex.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userid); err != nil {
+		return nil, err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	str := "INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)"
+	codes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(enc.EncodeToString(b))
+		code := c[:5] + "-" + c[5:]
+		if _, err := ex.Exec(str, userid, token.Hash(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func getMFA(qr db.Queryer, userid int64) (*MFA, error) {
+	str := "SELECT * FROM user_mfa WHERE user_id = ?"
+	m := MFA{}
+	err := qr.Get(&m, str, userid)
+	return &m, err
+}
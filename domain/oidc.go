@@ -0,0 +1,280 @@
+package domain
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/oidc"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrInvalidOIDCState is an unknown, expired or used login state error
+var ErrInvalidOIDCState = fmt.Errorf("Invalid or expired login state")
+
+// ErrOIDCNoAccount is returned when an identity is not linked to a user and may not sign up
+var ErrOIDCNoAccount = fmt.Errorf("No account is linked to this identity")
+
+// ErrIdentityLinked is returned when linking an identity that belongs to another user
+var ErrIdentityLinked = fmt.Errorf("Identity is linked to another account")
+
+// OIDCLogin is a started login with an identity provider. Only the hashes of
+// the state and of the binding held by the browser that started it are stored
+type OIDCLogin struct {
+	OIDCLoginID int64        `db:"oidc_login_id" json:"oidc_login_id"`
+	Provider    string       `db:"provider" json:"provider"`
+	StateHash   string       `db:"state_hash" json:"-"`
+	BindingHash string       `db:"binding_hash" json:"-"`
+	Nonce       string       `db:"nonce" json:"-"`
+	Verifier    string       `db:"verifier" json:"-"`
+	UserID      db.NullInt64 `db:"user_id" json:"user_id"` // set when linking to a logged in user
+	ExpiresOn   time.Time    `db:"expires_on" json:"expires_on"`
+	UsedOn      db.NullTime  `db:"used_on" json:"used_on"`
+	CreatedOn   time.Time    `db:"created_on" json:"created_on"`
+}
+
+// UserIdentity is an external identity linked to a user
+type UserIdentity struct {
+	UserIdentityID int64       `db:"user_identity_id" json:"user_identity_id"`
+	UserID         int64       `db:"user_id" json:"user_id"`
+	Provider       string      `db:"provider" json:"provider"`
+	Subject        string      `db:"subject" json:"subject"`
+	Email          string      `db:"email" json:"email"`
+	CreatedOn      time.Time   `db:"created_on" json:"created_on"`
+	LastLoginOn    db.NullTime `db:"last_login_on" json:"last_login_on"`
+}
+
+// StartOIDCLogin returns the provider url to send the user to and a binding
+// the initiator must keep, the login can only be completed with it.
+// linkUserID links the identity to a logged in user, pass 0 to login
+func StartOIDCLogin(ex db.Execer, provider string, linkUserID int64) (authURL, binding string, err error) {
+	p, err := oidc.GetProvider(provider)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := oidc.Random(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err = oidc.Random(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := oidc.Random(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return "", "", err
+	}
+	authURL, err = p.AuthURL(state, nonce, challenge)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	l := OIDCLogin{
+		Provider:  provider,
+		StateHash:   token.Hash(state),
+		BindingHash: token.Hash(binding),
+		Nonce:       nonce,
+		Verifier:    verifier,
+		ExpiresOn:   now.Add(oidcLoginTTL),
+		CreatedOn:   now,
+	}
+	if linkUserID > 0 {
+		l.UserID = db.NewNullInt64(linkUserID)
+	}
+	str := `
+	INSERT INTO oidc_logins
+		(provider, state_hash, binding_hash, nonce, verifier, user_id, expires_on, created_on)
+		VALUES
+		(:provider, :state_hash, :binding_hash, :nonce, :verifier, :user_id, :expires_on, :created_on)
+	`
+	if _, err := ex.NamedExec(str, &l); err != nil {
+		return "", "", err
+	}
+	return authURL, binding, nil
+}
+
+// CompleteOIDCLogin exchanges the code returned by the provider and returns
+// the user the identity is linked to. binding is the value StartOIDCLogin
+// gave the initiator, so a state can not be completed by someone else.
+// Unknown identities are linked to the user that started a link, to a user
+// with the same verified email if the provider allows it, or to a new user if
+// the provider allows sign up
+func CompleteOIDCLogin(st db.Storer, provider, state, binding, code string) (*User, error) {
+	p, err := oidc.GetProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	l, err := useOIDCLogin(st, provider, state, binding)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.Exchange(code, l.Verifier, l.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	verified := bool(claims.EmailVerified) && email != ""
+
+	ident, err := getIdentity(st, provider, claims.Subject)
+	switch {
+	case err == nil && l.UserID.Valid && ident.UserID != l.UserID.Int64:
+		return nil, ErrIdentityLinked
+	case err == nil:
+	case err != sql.ErrNoRows:
+		return nil, err
+	case l.UserID.Valid:
+		ident, err = linkIdentity(st, l.UserID.Int64, provider, claims.Subject, email)
+	case !verified:
+		return nil, ErrOIDCNoAccount
+	default:
+		uid, uerr := GetUserID(st, email)
+		switch {
+		case uerr == nil && p.LinkByEmail:
+		case uerr == sql.ErrNoRows && p.AllowSignup:
+			usr, cerr := createOIDCUser(st, claims.GivenName, claims.FamilyName, email)
+			if cerr != nil {
+				return nil, cerr
+			}
+			uid = usr.UserID
+		case uerr == nil, uerr == sql.ErrNoRows:
+			return nil, ErrOIDCNoAccount
+		default:
+			return nil, uerr
+		}
+		ident, err = linkIdentity(st, uid, provider, claims.Subject, email)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	str := "UPDATE user_identities SET last_login_on = ? WHERE user_identity_id = ?"
+	if _, err := st.Exec(str, now, ident.UserIdentityID); err != nil {
+		return nil, err
+	}
+	usr, err := GetUserWithID(st, ident.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted {
+		return nil, ErrUserDeleted
+	}
+	if usr.Status == StatusInvited {
+		return nil, ErrOIDCNoAccount
+	}
+	// the provider vouches for the email the account uses
+	if !usr.Verified() && verified && strings.EqualFold(usr.Email, email) {
+		str := "UPDATE users SET email_verified_on = ? WHERE user_id = ? AND email_verified_on IS NULL"
+		if _, err := st.Exec(str, now, usr.UserID); err != nil {
+			return nil, err
+		}
+		usr.VerifiedOn = db.NewNullTime(now)
+	}
+	return usr, nil
+}
+
+// GetUserIdentities returns the identities linked to a user
+func GetUserIdentities(qr db.Queryer, userid int64) ([]UserIdentity, error) {
+	str := "SELECT * FROM user_identities WHERE user_id = ? ORDER BY user_identity_id"
+	idents := []UserIdentity{}
+	err := qr.Select(&idents, str, userid)
+	return idents, err
+}
+
+// UnlinkIdentity removes one of a user's identities
+func UnlinkIdentity(ex db.Execer, userid, identityid int64) error {
+	str := "DELETE FROM user_identities WHERE user_identity_id = ? AND user_id = ?"
+	_, err := ex.Exec(str, identityid, userid)
+	return err
+}
+
+// useOIDCLogin marks a login state used and returns it. The binding must be
+// the one issued with the state
+func useOIDCLogin(st db.Storer, provider, state, binding string) (*OIDCLogin, error) {
+	l := OIDCLogin{}
+	str := "SELECT * FROM oidc_logins WHERE state_hash = ? AND provider = ?"
+	err := st.Get(&l, str, token.Hash(state), provider)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if l.UsedOn.Valid || now.After(l.ExpiresOn) {
+		return nil, ErrInvalidOIDCState
+	}
+	if binding == "" || subtle.ConstantTimeCompare([]byte(l.BindingHash), []byte(token.Hash(binding))) != 1 {
+		return nil, ErrInvalidOIDCState
+	}
+	str = "UPDATE oidc_logins SET used_on = ? WHERE oidc_login_id = ? AND used_on IS NULL"
+	res, err := st.Exec(str, now, l.OIDCLoginID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return nil, ErrInvalidOIDCState
+	}
+	return &l, nil
+}
+
+func getIdentity(qr db.Queryer, provider, subject string) (*UserIdentity, error) {
+	str := "SELECT * FROM user_identities WHERE provider = ? AND subject = ?"
+	ident := UserIdentity{}
+	err := qr.Get(&ident, str, provider, subject)
+	return &ident, err
+}
+
+func linkIdentity(ex db.Execer, userid int64, provider, subject, email string) (*UserIdentity, error) {
+	ident := UserIdentity{
+		UserID:    userid,
+		Provider:  provider,
+		Subject:   subject,
+		Email:     email,
+		CreatedOn: time.Now(),
+	}
+	str := `
+	INSERT INTO user_identities
+		(user_id, provider, subject, email, created_on)
+		VALUES
+		(:user_id, :provider, :subject, :email, :created_on)
+	`
+	resp, err := ex.NamedExec(str, &ident)
+	if err != nil {
+		return nil, err
+	}
+	ident.UserIdentityID, err = resp.LastInsertId()
+	return &ident, err
+}
+
+// createOIDCUser creates a verified user without a password. They may set
+// one with a password reset
+func createOIDCUser(ex db.Execer, fn, ln, email string) (*User, error) {
+	u := NewUser(fn, ln, email)
+	now := time.Now()
+	u.VerifiedOn = db.NewNullTime(now)
+	u.Status = StatusActive
+	str := `
+	INSERT INTO users
+		(first_name, last_name, email, email_verified_on, status)
+		VALUES
+		(:first_name, :last_name, :email, :email_verified_on, :status)
+	`
+	resp, err := ex.NamedExec(str, u)
+	if err != nil {
+		return nil, err
+	}
+	if u.UserID, err = resp.LastInsertId(); err != nil {
+		return nil, err
+	}
+	u.Roles = []int64{RoleUser}
+	return u, AddUserRoles(ex, u.UserID, RoleUser)
+}
@@ -0,0 +1,186 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/oidc"
+	"github.com/rajendraventurit/radicaapi/lib/oidc/oidctest"
+)
+
+// testDB connects to the local database, the test is skipped without one
+func testDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	d, err := db.ConnectLocal()
+	if err != nil {
+		t.Skipf("no local database: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// stubProvider registers a stub identity provider as name
+func stubProvider(t *testing.T, name string, signup bool) *oidctest.Server {
+	t.Helper()
+	srv, err := oidctest.NewServer("radica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	oidc.SetHTTPClient(srv.Client())
+	p := &oidc.Provider{
+		Issuer:      srv.URL,
+		ClientID:    "radica",
+		RedirectURL: "https://app.example.com/oidc/callback",
+		AllowSignup: signup,
+	}
+	if err := oidc.AddProvider(name, p); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// testIdentity returns an identity unique to this run
+func testIdentity(t *testing.T) oidctest.Identity {
+	id := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	return oidctest.Identity{
+		Subject:       id,
+		Email:         id + "@example.com",
+		EmailVerified: true,
+		GivenName:     "Test",
+		FamilyName:    "User",
+	}
+}
+
+func testUser(t *testing.T, d *sqlx.DB) *User {
+	t.Helper()
+	usr, err := createOIDCUser(d, "Link", "User", testIdentity(t).Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteTestUser(t, d, usr.UserID)
+	return usr
+}
+
+func deleteTestUser(t *testing.T, d *sqlx.DB, userid int64) {
+	t.Cleanup(func() { d.Exec("DELETE FROM users WHERE user_id = ?", userid) })
+}
+
+// oidcLogin starts a login at the stub provider, linking to linkUserID if
+// it is set, and returns what the provider redirects back with
+func oidcLogin(t *testing.T, d *sqlx.DB, srv *oidctest.Server, provider string, linkUserID int64, ident oidctest.Identity) (state, binding, code string) {
+	t.Helper()
+	authURL, binding, err := StartOIDCLogin(d, provider, linkUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state, err = srv.Authorize(authURL, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, binding, code
+}
+
+func TestOIDCLoginSignup(t *testing.T) {
+	d := testDB(t)
+	srv := stubProvider(t, "stub-signup", true)
+	ident := testIdentity(t)
+
+	state, binding, code := oidcLogin(t, d, srv, "stub-signup", 0, ident)
+	usr, err := CompleteOIDCLogin(d, "stub-signup", state, binding, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteTestUser(t, d, usr.UserID)
+	if usr.Email != ident.Email || !usr.Verified() || usr.Status != StatusActive {
+		t.Errorf("signup user %+v", usr)
+	}
+
+	// the identity now logs in to the same user
+	state, binding, code = oidcLogin(t, d, srv, "stub-signup", 0, ident)
+	again, err := CompleteOIDCLogin(d, "stub-signup", state, binding, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.UserID != usr.UserID {
+		t.Errorf("login returned user %v, want %v", again.UserID, usr.UserID)
+	}
+}
+
+func TestOIDCLoginNoAccount(t *testing.T) {
+	d := testDB(t)
+	srv := stubProvider(t, "stub", false)
+	state, binding, code := oidcLogin(t, d, srv, "stub", 0, testIdentity(t))
+	if _, err := CompleteOIDCLogin(d, "stub", state, binding, code); err != ErrOIDCNoAccount {
+		t.Errorf("login without signup = %v, want %v", err, ErrOIDCNoAccount)
+	}
+}
+
+func TestOIDCLoginBinding(t *testing.T) {
+	d := testDB(t)
+	srv := stubProvider(t, "stub", false)
+	usr := testUser(t, d)
+	state, binding, code := oidcLogin(t, d, srv, "stub", usr.UserID, testIdentity(t))
+
+	// someone else completing the state, as in login csrf, is refused
+	for _, b := range []string{"", binding + "x"} {
+		if _, err := CompleteOIDCLogin(d, "stub", state, b, code); err != ErrInvalidOIDCState {
+			t.Errorf("binding %q = %v, want %v", b, err, ErrInvalidOIDCState)
+		}
+	}
+	// and does not use up the initiator's state
+	got, err := CompleteOIDCLogin(d, "stub", state, binding, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != usr.UserID {
+		t.Errorf("link returned user %v, want %v", got.UserID, usr.UserID)
+	}
+	if _, err := CompleteOIDCLogin(d, "stub", state, binding, code); err != ErrInvalidOIDCState {
+		t.Errorf("reused state = %v, want %v", err, ErrInvalidOIDCState)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	d := testDB(t)
+	srv := stubProvider(t, "stub", false)
+	usr := testUser(t, d)
+	other := testUser(t, d)
+	ident := testIdentity(t)
+	// the provider's email need not match the user linking
+	ident.Email = "someone-else@example.com"
+
+	state, binding, code := oidcLogin(t, d, srv, "stub", usr.UserID, ident)
+	got, err := CompleteOIDCLogin(d, "stub", state, binding, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != usr.UserID {
+		t.Fatalf("link returned user %v, want %v", got.UserID, usr.UserID)
+	}
+	idents, err := GetUserIdentities(d, usr.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idents) != 1 || idents[0].Subject != ident.Subject {
+		t.Errorf("identities %+v, want subject %s", idents, ident.Subject)
+	}
+
+	// a login with the linked identity is the linked user
+	state, binding, code = oidcLogin(t, d, srv, "stub", 0, ident)
+	if got, err = CompleteOIDCLogin(d, "stub", state, binding, code); err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != usr.UserID {
+		t.Errorf("login returned user %v, want %v", got.UserID, usr.UserID)
+	}
+
+	// and it may not be linked to anyone else
+	state, binding, code = oidcLogin(t, d, srv, "stub", other.UserID, ident)
+	if _, err := CompleteOIDCLogin(d, "stub", state, binding, code); err != ErrIdentityLinked {
+		t.Errorf("linking another user's identity = %v, want %v", err, ErrIdentityLinked)
+	}
+}
@@ -0,0 +1,356 @@
+package domain
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// ErrOrgNotFound is an unknown or deleted organization error
+var ErrOrgNotFound = fmt.Errorf("Organization not found")
+
+// ErrInvalidOrgType is returned for an unknown org type or one that may not
+// be nested under its parent
+var ErrInvalidOrgType = fmt.Errorf("Invalid organization type")
+
+// ErrOrgHasChildren is returned when deleting an organization with children
+var ErrOrgHasChildren = fmt.Errorf("Organization has child organizations")
+
+// ErrNotOrgMember is returned when a user who may not add members changes
+// someone outside the organization
+var ErrNotOrgMember = fmt.Errorf("User is not a member of the organization")
+
+// Organization is an organization, location or department. Members of an
+// organization have their role there in every child organization
+type Organization struct {
+	OrganizationID int64        `db:"organization_id" json:"organization_id"`
+	ParentID       db.NullInt64 `db:"parent_id" json:"parent_id"`
+	OrgType        int64        `db:"org_type" json:"org_type"`
+	Name           string       `db:"name" json:"name"`
+	CreatedOn      time.Time    `db:"created_on" json:"created_on"`
+	UpdatedOn      time.Time    `db:"updated_on" json:"updated_on"`
+	Deleted        bool         `db:"deleted" json:"-"`
+}
+
+// CreateOrganization creates an organization. parentID nests it under
+// another, pass 0 for a top level organization. A child may not be a higher
+// org type than its parent
+func CreateOrganization(qe db.QueryExecer, name string, orgType, parentID int64) (*Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("name required")
+	}
+	if orgType < OrgOrganization || orgType > OrgDepartment {
+		return nil, ErrInvalidOrgType
+	}
+	o := Organization{Name: name, OrgType: orgType}
+	if parentID > 0 {
+		parent, err := GetOrganization(qe, parentID)
+		if err != nil {
+			return nil, err
+		}
+		if orgType < parent.OrgType {
+			return nil, ErrInvalidOrgType
+		}
+		ids, err := orgAncestors(qe, parentID)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) >= maxOrgDepth {
+			return nil, fmt.Errorf("organizations may only be nested %v deep", maxOrgDepth)
+		}
+		o.ParentID = db.NewNullInt64(parentID)
+	}
+	str := `
+	INSERT INTO organizations
+		(parent_id, org_type, name)
+		VALUES
+		(:parent_id, :org_type, :name)
+	`
+	resp, err := qe.NamedExec(str, &o)
+	if err != nil {
+		return nil, err
+	}
+	id, err := resp.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return GetOrganization(qe, id)
+}
+
+// GetOrganization returns an organization that has not been deleted
+func GetOrganization(qr db.Queryer, orgid int64) (*Organization, error) {
+	o := Organization{}
+	str := "SELECT * FROM organizations WHERE organization_id = ? AND deleted = false"
+	err := qr.Get(&o, str, orgid)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// GetOrganizations returns every organization
+func GetOrganizations(qr db.Queryer) ([]Organization, error) {
+	str := "SELECT * FROM organizations WHERE deleted = false ORDER BY organization_id"
+	orgs := []Organization{}
+	err := qr.Select(&orgs, str)
+	return orgs, err
+}
+
+// GetUserOrganizations returns the organizations a user is a member of
+func GetUserOrganizations(qr db.Queryer, userid int64) ([]Organization, error) {
+	str := `
+	SELECT o.*
+	FROM organizations o
+	INNER JOIN organization_users ou
+	ON ou.organization_id = o.organization_id
+	WHERE ou.user_id = ?
+	AND o.deleted = false
+	ORDER BY o.organization_id
+	`
+	orgs := []Organization{}
+	err := qr.Select(&orgs, str, userid)
+	return orgs, err
+}
+
+// GetChildOrganizations returns the organizations directly under orgid
+func GetChildOrganizations(qr db.Queryer, orgid int64) ([]Organization, error) {
+	str := "SELECT * FROM organizations WHERE parent_id = ? AND deleted = false ORDER BY organization_id"
+	orgs := []Organization{}
+	err := qr.Select(&orgs, str, orgid)
+	return orgs, err
+}
+
+// RenameOrganization will change an organization's name
+func RenameOrganization(ex db.Execer, orgid int64, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("name required")
+	}
+	str := "UPDATE organizations SET name = ? WHERE organization_id = ? AND deleted = false"
+	_, err := ex.Exec(str, name, orgid)
+	return err
+}
+
+// DeleteOrganization marks an organization deleted and removes its members.
+// Child organizations must be deleted first
+func DeleteOrganization(st db.Storer, orgid int64) error {
+	children, err := GetChildOrganizations(st, orgid)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return ErrOrgHasChildren
+	}
+	tx, err := st.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE organizations SET deleted = true WHERE organization_id = ?", orgid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM organization_users WHERE organization_id = ?", orgid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetOrganizationUsers returns the members of an organization
+func GetOrganizationUsers(qr db.Queryer, orgid int64) ([]OrganizationUser, error) {
+	str := `
+	SELECT ou.organization_id, ou.user_id, ou.role
+	FROM organization_users ou
+	INNER JOIN users u
+	ON u.user_id = ou.user_id
+	WHERE ou.organization_id = ?
+	AND u.status != ?
+	ORDER BY ou.user_id
+	`
+	users := []OrganizationUser{}
+	err := qr.Select(&users, str, orgid, StatusDeleted)
+	return users, err
+}
+
+// SetOrganizationUser adds a user to an organization or changes their role
+// there. grantor may only grant a role whose permissions they hold in the
+// organization, and only change members whose current role they could grant.
+// Members can read each other's reports, so only users whose own roles grant
+// PermManageOrg may add someone who is not already a member
+func SetOrganizationUser(qe db.QueryExecer, grantor, orgid, userid, role int64) error {
+	have, err := GetOrgPermissions(qe, grantor, orgid)
+	if err != nil {
+		return err
+	}
+	need, err := GetRolePermissions(qe, role)
+	if err != nil {
+		return err
+	}
+	if len(need) == 0 || !HasPermissions(have, need...) {
+		return ErrRoleNotGrantable
+	}
+	if IsUserDeleted(qe, userid) {
+		return ErrUserDeleted
+	}
+	err = checkOrgMember(qe, have, orgid, userid)
+	if err == sql.ErrNoRows {
+		perms, perr := GetUserPermissions(qe, grantor)
+		if perr != nil {
+			return perr
+		}
+		if !HasPermissions(perms, PermManageOrg) {
+			return ErrNotOrgMember
+		}
+	} else if err != nil {
+		return err
+	}
+	str := `
+	INSERT INTO organization_users
+		(organization_id, user_id, role)
+		VALUES
+		(?, ?, ?)
+	ON DUPLICATE KEY UPDATE role = VALUES(role)
+	`
+	_, err = qe.Exec(str, orgid, userid, role)
+	return err
+}
+
+// RemoveOrganizationUser removes a user from an organization. grantor must
+// hold the permissions of the member's role in the organization
+func RemoveOrganizationUser(qe db.QueryExecer, grantor, orgid, userid int64) error {
+	have, err := GetOrgPermissions(qe, grantor, orgid)
+	if err != nil {
+		return err
+	}
+	err = checkOrgMember(qe, have, orgid, userid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	str := "DELETE FROM organization_users WHERE organization_id = ? AND user_id = ?"
+	_, err = qe.Exec(str, orgid, userid)
+	return err
+}
+
+// checkOrgMember returns ErrRoleNotGrantable unless have holds every
+// permission of the user's current role in the organization, or
+// sql.ErrNoRows if they are not a member
+func checkOrgMember(qr db.Queryer, have []int64, orgid, userid int64) error {
+	var role int64
+	str := "SELECT role FROM organization_users WHERE organization_id = ? AND user_id = ?"
+	if err := qr.Get(&role, str, orgid, userid); err != nil {
+		return err
+	}
+	need, err := GetRolePermissions(qr, role)
+	if err != nil {
+		return err
+	}
+	if !HasPermissions(have, need...) {
+		return ErrRoleNotGrantable
+	}
+	return nil
+}
+
+// GetOrgPermissions returns the permissions a user has in an organization
+// from their roles in it and in its parents. Users whose own roles grant
+// PermManageOrg have those permissions in every organization
+func GetOrgPermissions(qr db.Queryer, userid, orgid int64) ([]int64, error) {
+	ids, err := orgAncestors(qr, orgid)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := GetUserPermissions(qr, userid)
+	if err != nil {
+		return nil, err
+	}
+	if HasPermissions(perms, PermManageOrg) {
+		return perms, nil
+	}
+	str, args, err := sqlx.In(`
+	SELECT DISTINCT rp.permission_id
+	FROM organization_users ou
+	INNER JOIN role_permissions rp
+	ON rp.role_id = ou.role
+	WHERE ou.user_id = ?
+	AND ou.organization_id IN (?)
+	ORDER BY rp.permission_id
+	`, userid, ids)
+	if err != nil {
+		return nil, err
+	}
+	perms = []int64{}
+	err = qr.Select(&perms, str, args...)
+	return perms, err
+}
+
+// GetOrgDiseases returns the disease reports of the members of an
+// organization and its children
+func GetOrgDiseases(qr db.Queryer, orgid int64) ([]Disease, error) {
+	ids, err := orgDescendants(qr, orgid)
+	if err != nil {
+		return nil, err
+	}
+	str, args, err := sqlx.In(`
+	SELECT d.id, d.disease, d.symtoms, d.disease_date, d.dbm, d.onscreen_time, d.user_id
+	FROM disease_by_radiation d
+	WHERE d.deleted = false
+	AND d.user_id IN (
+		SELECT user_id FROM organization_users WHERE organization_id IN (?)
+	)
+	ORDER BY d.disease_date DESC
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	diseases := []Disease{}
+	err = qr.Select(&diseases, str, args...)
+	return diseases, err
+}
+
+// orgAncestors returns orgid followed by its parents up to the top level
+func orgAncestors(qr db.Queryer, orgid int64) ([]int64, error) {
+	o, err := GetOrganization(qr, orgid)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{o.OrganizationID}
+	for len(ids) < maxOrgDepth && o.ParentID.Valid {
+		if o, err = GetOrganization(qr, o.ParentID.Int64); err == ErrOrgNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, o.OrganizationID)
+	}
+	return ids, nil
+}
+
+// orgDescendants returns orgid followed by every organization under it
+func orgDescendants(qr db.Queryer, orgid int64) ([]int64, error) {
+	ids := []int64{orgid}
+	level := ids
+	for depth := 1; depth < maxOrgDepth && len(level) > 0; depth++ {
+		str, args, err := sqlx.In("SELECT organization_id FROM organizations WHERE parent_id IN (?) AND deleted = false", level)
+		if err != nil {
+			return nil, err
+		}
+		children := []int64{}
+		if err := qr.Select(&children, str, args...); err != nil {
+			return nil, err
+		}
+		ids = append(ids, children...)
+		level = children
+	}
+	return ids, nil
+}
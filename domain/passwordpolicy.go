@@ -0,0 +1,212 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/password"
+)
+
+// Password policy rules
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleUpper     = "upper"
+	RuleLower     = "lower"
+	RuleNumber    = "number"
+	RuleSpecial   = "special"
+	RuleUserInfo  = "user_info"
+	RuleForbidden = "forbidden"
+	RuleHistory   = "history"
+)
+
+// PasswordPolicy are the rules a password must meet
+type PasswordPolicy struct {
+	MinLength      int      `json:"min_length"`
+	MaxLength      int      `json:"max_length"`
+	RequireUpper   bool     `json:"require_upper"`
+	RequireLower   bool     `json:"require_lower"`
+	RequireNumber  bool     `json:"require_number"`
+	RequireSpecial bool     `json:"require_special"`
+	History        int      `json:"history"`          // previous passwords that may not be reused
+	MaxAgeDays     int      `json:"max_age_days"`     // 0 never expires
+	ForbidUserInfo bool     `json:"forbid_user_info"` // the email or name may not appear
+	Forbidden      []string `json:"forbidden"`        // case insensitive
+}
+
+// PasswordViolation is a rule a password did not meet
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordError is returned when a password does not meet the policy
+type PasswordError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e PasswordError) Error() string {
+	msgs := []string{}
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func (e *PasswordError) add(rule, format string, ii ...interface{}) {
+	e.Violations = append(e.Violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, ii...)})
+}
+
+// GetPasswordPolicy returns the configured password policy
+func GetPasswordPolicy() PasswordPolicy {
+	return localConf.PasswordPolicy
+}
+
+// Check returns a PasswordError listing every rule pass does not meet.
+// usr may be nil, otherwise its email and name are checked
+func (p PasswordPolicy) Check(pass string, usr *User) error {
+	perr := PasswordError{}
+	n := utf8.RuneCountInString(pass)
+	if n < p.MinLength {
+		perr.add(RuleMinLength, "password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		perr.add(RuleMaxLength, "password must be at most %d characters long", p.MaxLength)
+	}
+
+	var upper, lower, number, special bool
+	for _, ch := range pass {
+		switch {
+		case unicode.IsNumber(ch):
+			number = true
+		case unicode.IsUpper(ch):
+			upper = true
+		case unicode.IsLower(ch):
+			lower = true
+		case unicode.IsPunct(ch) || unicode.IsSymbol(ch):
+			special = true
+		}
+	}
+	if p.RequireLower && !lower {
+		perr.add(RuleLower, "lowercase letter missing")
+	}
+	if p.RequireUpper && !upper {
+		perr.add(RuleUpper, "uppercase letter missing")
+	}
+	if p.RequireNumber && !number {
+		perr.add(RuleNumber, "atleast one numeric character required")
+	}
+	if p.RequireSpecial && !special {
+		perr.add(RuleSpecial, "special character missing")
+	}
+
+	lpass := strings.ToLower(pass)
+	if p.ForbidUserInfo && usr != nil {
+		for _, info := range userInfo(usr) {
+			if strings.Contains(lpass, info) {
+				perr.add(RuleUserInfo, "password may not contain your email or name")
+				break
+			}
+		}
+	}
+	for _, f := range p.Forbidden {
+		if f != "" && strings.Contains(lpass, strings.ToLower(f)) {
+			perr.add(RuleForbidden, "password may not contain %q", f)
+		}
+	}
+
+	if len(perr.Violations) > 0 {
+		return perr
+	}
+	return nil
+}
+
+// Expired returns true if a password changed on changed is older than MaxAgeDays
+func (p PasswordPolicy) Expired(changed time.Time) bool {
+	if p.MaxAgeDays <= 0 {
+		return false
+	}
+	return time.Since(changed) > time.Duration(p.MaxAgeDays)*24*time.Hour
+}
+
+// PasswordExpired returns true if the user's password is older than the policy
+// allows. Users without a password, such as those signed up with an identity
+// provider, never expire
+func (u User) PasswordExpired() bool {
+	if len(u.HashedPass) == 0 {
+		return false
+	}
+	changed := u.CreatedOn
+	if u.PassChanged.Valid {
+		changed = u.PassChanged.Time
+	}
+	return GetPasswordPolicy().Expired(changed)
+}
+
+// CheckPassword checks a new password for a user against the policy,
+// including the user's password history
+func CheckPassword(qr db.Queryer, userid int64, pass string) error {
+	usr, err := GetUserWithID(qr, userid)
+	if err != nil {
+		return err
+	}
+	p := GetPasswordPolicy()
+	perr, _ := p.Check(pass, usr).(PasswordError)
+	reused, err := passwordInHistory(qr, usr, pass, p.History)
+	if err != nil {
+		return err
+	}
+	if reused {
+		perr.add(RuleHistory, "password may not be one of your last %d passwords", p.History)
+	}
+	if len(perr.Violations) > 0 {
+		return perr
+	}
+	return nil
+}
+
+// passwordInHistory returns true if pass is the current password or one of the
+// most recent depth passwords
+func passwordInHistory(qr db.Queryer, usr *User, pass string, depth int) (bool, error) {
+	if depth <= 0 {
+		return false, nil
+	}
+	hashes := []string{string(usr.HashedPass)}
+	str := `
+	SELECT password FROM user_passwords
+	WHERE user_id = ?
+	ORDER BY user_password_id DESC
+	LIMIT ?
+	`
+	old := []string{}
+	if err := qr.Select(&old, str, usr.UserID, depth); err != nil {
+		return false, err
+	}
+	hashes = append(hashes, old...)
+	for _, h := range hashes {
+		if h == "" {
+			continue
+		}
+		if password.Compare(h, pass) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userInfo returns the parts of a user's email and name a password may not contain
+func userInfo(usr *User) []string {
+	info := []string{}
+	local := strings.SplitN(strings.ToLower(usr.Email), "@", 2)[0]
+	for _, s := range []string{local, usr.FirstName.String, usr.LastName.String} {
+		// very short names would forbid too many passwords
+		if s = strings.ToLower(strings.TrimSpace(s)); utf8.RuneCountInString(s) >= 3 {
+			info = append(info, s)
+		}
+	}
+	return info
+}
@@ -0,0 +1,160 @@
+package domain
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/smtp"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrInvalidResetToken is an unknown, expired or used reset token error
+var ErrInvalidResetToken = fmt.Errorf("Invalid or expired reset token")
+
+// PasswordReset is a single use password reset token. Only the hash of the
+// token is stored
+type PasswordReset struct {
+	PasswordResetID int64       `db:"password_reset_id" json:"password_reset_id"`
+	UserID          int64       `db:"user_id" json:"user_id"`
+	TokenHash       string      `db:"token_hash" json:"-"`
+	ExpiresOn       time.Time   `db:"expires_on" json:"expires_on"`
+	UsedOn          db.NullTime `db:"used_on" json:"used_on"`
+	CreatedOn       time.Time   `db:"created_on" json:"created_on"`
+}
+
+// SendResetToken will email a user a link with a new reset token. Earlier
+// tokens are invalidated. Unknown and deleted emails are ignored so callers
+// can not discover accounts. The lookup and email happen in the background
+// and failures are logged, so the call takes as long either way. st must not
+// be a transaction
+func SendResetToken(st db.Storer, email string) error {
+	if localConf.PasswordReset.URL == "" {
+		return fmt.Errorf("password reset url not configured")
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	go func() {
+		if err := sendResetToken(st, email); err != nil {
+			logger.Errorf("sendResetToken %v", err)
+		}
+	}()
+	return nil
+}
+
+// sendResetToken emails the reset link if email belongs to a user
+func sendResetToken(st db.Storer, email string) error {
+	conf := localConf.PasswordReset
+	usr, err := GetUserWithEmail(st, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if usr.Deleted || usr.Status == StatusInvited {
+		return nil
+	}
+
+	tok, err := token.Random(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := invalidateResetTokens(st, usr.UserID, now); err != nil {
+		return err
+	}
+	str := `
+	INSERT INTO password_resets
+		(user_id, token_hash, expires_on, created_on)
+		VALUES
+		(?, ?, ?, ?)
+	`
+	exp := now.Add(time.Duration(conf.ExpireMinutes) * time.Minute)
+	if _, err := st.Exec(str, usr.UserID, token.Hash(tok), exp, now); err != nil {
+		return err
+	}
+
+	rurl := fmt.Sprintf("%s?t=%s", conf.URL, url.QueryEscape(tok))
+	mailer := smtp.SMTP{}
+
+	fname := fmt.Sprintf("%v/%v", defTemplatePath, "resetpass.html")
+	tmp, err := template.ParseFiles(fname)
+	if err != nil {
+		return err
+	}
+	p := struct {
+		Link    string
+		Minutes int
+	}{Link: rurl, Minutes: conf.ExpireMinutes}
+	var b bytes.Buffer
+	err = tmp.Execute(&b, p)
+	if err != nil {
+		return err
+	}
+	return mailer.Send("Password Reset", b.String(), nil, usr.Email)
+}
+
+// ResetPassword will reset a users password validated with a reset token.
+// The token is used up, every token issued to the user is revoked and, as
+// the user proved they own the email, it is marked verified
+func ResetPassword(st db.Storer, tok, newpass string) error {
+	pr := PasswordReset{}
+	str := "SELECT * FROM password_resets WHERE token_hash = ?"
+	err := st.Get(&pr, str, token.Hash(tok))
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if pr.UsedOn.Valid || now.After(pr.ExpiresOn) {
+		return ErrInvalidResetToken
+	}
+	// check before using the token so a rejected password can be retried
+	if err := CheckPassword(st, pr.UserID, newpass); err != nil {
+		return err
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return err
+	}
+	str = "UPDATE password_resets SET used_on = ? WHERE password_reset_id = ? AND used_on IS NULL"
+	res, err := tx.Exec(str, now, pr.PasswordResetID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		_ = tx.Rollback()
+		return ErrInvalidResetToken
+	}
+	if err := setPassword(tx, pr.UserID, newpass); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	str = "UPDATE users SET email_verified_on = ? WHERE user_id = ? AND email_verified_on IS NULL"
+	if _, err := tx.Exec(str, now, pr.UserID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := RevokeAllTokens(tx, pr.UserID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// invalidateResetTokens uses up a user's outstanding reset tokens
+func invalidateResetTokens(ex db.Execer, userid int64, now time.Time) error {
+	str := "UPDATE password_resets SET used_on = ? WHERE user_id = ? AND used_on IS NULL"
+	_, err := ex.Exec(str, now, userid)
+	return err
+}
@@ -0,0 +1,291 @@
+package domain
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// Erasure modes
+const (
+	EraseAnonymize = "anonymize" // scrub the user row and remove their data
+	EraseDelete    = "delete"    // remove the user row as well
+)
+
+// ErrInvalidEraseMode is an unknown erasure mode error
+var ErrInvalidEraseMode = fmt.Errorf("Invalid erasure mode")
+
+// userDataTables hold rows that belong to a user by user_id. They are
+// removed on erasure, children before parents
+var userDataTables = []string{
+	"disease_by_radiation",
+	"user_disease",
+	"user_passwords",
+	"password_resets",
+	"login_links",
+	"user_recovery_codes",
+	"user_mfa",
+	"mfa_attempts",
+	"api_keys",
+	"refresh_tokens",
+	"user_sessions",
+	"oidc_logins",
+	"user_identities",
+	"account_locks",
+	"organization_users",
+	"user_roles",
+}
+
+// LoginAttempt is a recorded login for an email
+type LoginAttempt struct {
+	IP        string    `db:"ip" json:"ip"`
+	Success   bool      `db:"success" json:"success"`
+	CreatedOn time.Time `db:"created_on" json:"created_on"`
+}
+
+// UserExport is the personal data held for a user. Secrets such as password
+// hashes and keys are not included
+type UserExport struct {
+	ExportedOn     time.Time          `json:"exported_on"`
+	User           *User              `json:"user"`
+	DiseaseReports []Disease          `json:"disease_reports"`
+	Diseases       []UserDisease      `json:"diseases"`
+	Sessions       []Session          `json:"sessions"`
+	Identities     []UserIdentity     `json:"identities"`
+	APIKeys        []APIKey           `json:"api_keys"`
+	Organizations  []OrganizationUser `json:"organizations"`
+	LoginAttempts  []LoginAttempt     `json:"login_attempts"`
+}
+
+// Erasure is the audit record of an erasure request. It keeps the user_id
+// but none of the erased data
+type Erasure struct {
+	ErasureID   int64     `db:"erasure_id" json:"erasure_id"`
+	UserID      int64     `db:"user_id" json:"user_id"`
+	RequestedBy int64     `db:"requested_by" json:"requested_by"`
+	Mode        string    `db:"mode" json:"mode"`
+	Reason      string    `db:"reason" json:"reason"`
+	RowsRemoved int64     `db:"rows_removed" json:"rows_removed"`
+	CreatedOn   time.Time `db:"created_on" json:"created_on"`
+}
+
+// ExportUserData collects everything tied to a user
+func ExportUserData(qr db.Queryer, userid int64) (*UserExport, error) {
+	usr, err := GetUserWithID(qr, userid)
+	if err != nil {
+		return nil, err
+	}
+	usr.Password = ""
+	e := UserExport{ExportedOn: time.Now(), User: usr}
+
+	str := "SELECT id, disease, symtoms, disease_date, dbm, onscreen_time, user_id FROM disease_by_radiation WHERE user_id = ? ORDER BY id"
+	e.DiseaseReports = []Disease{}
+	if err := qr.Select(&e.DiseaseReports, str, userid); err != nil {
+		return nil, err
+	}
+	if e.Diseases, err = GetUserDiseases(qr, userid); err != nil {
+		return nil, err
+	}
+	str = "SELECT * FROM user_sessions WHERE user_id = ? ORDER BY session_id"
+	e.Sessions = []Session{}
+	if err := qr.Select(&e.Sessions, str, userid); err != nil {
+		return nil, err
+	}
+	if e.Identities, err = GetUserIdentities(qr, userid); err != nil {
+		return nil, err
+	}
+	str = "SELECT * FROM api_keys WHERE user_id = ? ORDER BY api_key_id"
+	e.APIKeys = []APIKey{}
+	if err := qr.Select(&e.APIKeys, str, userid); err != nil {
+		return nil, err
+	}
+	for i := range e.APIKeys {
+		e.APIKeys[i].Scopes = splitScopes(e.APIKeys[i].ScopesStr)
+	}
+	str = "SELECT organization_id, user_id, role FROM organization_users WHERE user_id = ? ORDER BY organization_id"
+	e.Organizations = []OrganizationUser{}
+	if err := qr.Select(&e.Organizations, str, userid); err != nil {
+		return nil, err
+	}
+	str = "SELECT ip, success, created_on FROM login_attempts WHERE email = ? ORDER BY created_on"
+	e.LoginAttempts = []LoginAttempt{}
+	if err := qr.Select(&e.LoginAttempts, str, usr.Email); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// WriteArchive writes the export as a zip of export.json with a csv of
+// each list
+func (e UserExport) WriteArchive(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("export.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(e); err != nil {
+		return err
+	}
+
+	reports := [][]string{{"id", "disease", "symtoms", "disease_date", "dbm", "onscreen_time"}}
+	for _, d := range e.DiseaseReports {
+		reports = append(reports, []string{
+			strconv.FormatInt(d.ID, 10), d.Disease.String, d.Symtoms.String, d.DiseaseDate.String,
+			nullInt(d.Dbm), nullInt(d.OnscreenTime),
+		})
+	}
+	diseases := [][]string{{"disease_id"}}
+	for _, d := range e.Diseases {
+		diseases = append(diseases, []string{strconv.FormatInt(d.DiseaseID, 10)})
+	}
+	sessions := [][]string{{"session_id", "device_id", "user_agent", "ip", "created_on", "last_seen_on", "revoked_on"}}
+	for _, s := range e.Sessions {
+		sessions = append(sessions, []string{
+			strconv.FormatInt(s.SessionID, 10), s.DeviceID, s.UserAgent, s.IP,
+			s.CreatedOn.Format(time.RFC3339), s.LastSeenOn.Format(time.RFC3339), nullTime(s.RevokedOn),
+		})
+	}
+	logins := [][]string{{"ip", "success", "created_on"}}
+	for _, l := range e.LoginAttempts {
+		logins = append(logins, []string{l.IP, strconv.FormatBool(l.Success), l.CreatedOn.Format(time.RFC3339)})
+	}
+	files := []struct {
+		name string
+		rows [][]string
+	}{
+		{"disease_reports.csv", reports},
+		{"diseases.csv", diseases},
+		{"sessions.csv", sessions},
+		{"login_attempts.csv", logins},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if err := csv.NewWriter(f).WriteAll(file.rows); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// EraseUser removes a user's data and either anonymizes or deletes the user.
+// The request is recorded in user_erasures. Outstanding access tokens are
+// revoked before anything is removed
+func EraseUser(st db.Storer, requestedBy, userid int64, mode, reason string) (*Erasure, error) {
+	if mode == "" {
+		mode = EraseAnonymize
+	}
+	if mode != EraseAnonymize && mode != EraseDelete {
+		return nil, ErrInvalidEraseMode
+	}
+	usr, err := GetUserWithID(st, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	// reject access tokens that have already been issued
+	if err := RevokeAllTokens(tx, userid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	var removed int64
+	for _, table := range userDataTables {
+		res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", table), userid)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE email = ?", usr.Email); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM login_link_requests WHERE email = ?", usr.Email); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	anon := fmt.Sprintf("erased-%d@invalid", userid)
+	if _, err := tx.Exec("UPDATE user_invites SET email = ?, user_id = NULL WHERE user_id = ?", anon, userid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if mode == EraseDelete {
+		_, err = tx.Exec("DELETE FROM users WHERE user_id = ?", userid)
+	} else {
+		str := `
+		UPDATE users
+		SET first_name = NULL, last_name = NULL, email = ?, password = NULL,
+			email_verified_on = NULL, password_changed_on = NULL, deleted = true, status = ?
+		WHERE user_id = ?
+		`
+		_, err = tx.Exec(str, anon, StatusDeleted, userid)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	e := Erasure{
+		UserID:      userid,
+		RequestedBy: requestedBy,
+		Mode:        mode,
+		Reason:      reason,
+		RowsRemoved: removed,
+		CreatedOn:   time.Now(),
+	}
+	str := `
+	INSERT INTO user_erasures
+		(user_id, requested_by, mode, reason, rows_removed, created_on)
+		VALUES
+		(:user_id, :requested_by, :mode, :reason, :rows_removed, :created_on)
+	`
+	resp, err := tx.NamedExec(str, &e)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if e.ErasureID, err = resp.LastInsertId(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return &e, tx.Commit()
+}
+
+// GetErasures returns the erasure audit trail, newest first
+func GetErasures(qr db.Queryer) ([]Erasure, error) {
+	str := "SELECT * FROM user_erasures ORDER BY erasure_id DESC"
+	erasures := []Erasure{}
+	err := qr.Select(&erasures, str)
+	return erasures, err
+}
+
+func nullInt(v db.NullInt64) string {
+	if !v.Valid {
+		return ""
+	}
+	return strconv.FormatInt(v.Int64, 10)
+}
+
+func nullTime(v db.NullTime) string {
+	if !v.Valid {
+		return ""
+	}
+	return v.Time.Format(time.RFC3339)
+}
@@ -0,0 +1,212 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ErrInvalidRefreshToken is an unknown, expired or revoked refresh token error
+var ErrInvalidRefreshToken = fmt.Errorf("Invalid refresh token")
+
+// ErrRefreshTokenReused is returned when a rotated refresh token is presented again
+var ErrRefreshTokenReused = fmt.Errorf("Refresh token has already been used")
+
+// RefreshToken is the server side record of an issued refresh token.
+// Tokens issued by rotating another token share its FamilyID
+type RefreshToken struct {
+	RefreshTokenID int64        `db:"refresh_token_id" json:"refresh_token_id"`
+	UserID         int64        `db:"user_id" json:"user_id"`
+	DeviceID       string       `db:"device_id" json:"device_id"`
+	FamilyID       string       `db:"family_id" json:"family_id"`
+	SessionID      db.NullInt64 `db:"session_id" json:"session_id"`
+	TokenHash      string       `db:"token_hash" json:"-"`
+	ExpiresOn      time.Time    `db:"expires_on" json:"expires_on"`
+	RotatedOn      db.NullTime  `db:"rotated_on" json:"rotated_on"`
+	RevokedOn      db.NullTime  `db:"revoked_on" json:"revoked_on"`
+	CreatedOn      time.Time    `db:"created_on" json:"created_on"`
+}
+
+// IssueTokens starts a session on the device and sets a new access token
+// and refresh token on the user. The refresh token is bound to the device id
+func IssueTokens(ex db.Execer, usr *User, dev Device) error {
+	family, err := token.Random(16)
+	if err != nil {
+		return err
+	}
+	exp := time.Now().Add(token.RefreshTTL())
+	sid, err := createSession(ex, usr.UserID, dev, exp)
+	if err != nil {
+		return err
+	}
+	return issueTokens(ex, usr, dev.ID, family, sid, exp)
+}
+
+func issueTokens(ex db.Execer, usr *User, deviceID, family string, sessionid int64, exp time.Time) error {
+	tok, err := token.NewSession(usr.UserID, sessionid)
+	if err != nil {
+		return err
+	}
+	refresh, err := token.NewRefresh()
+	if err != nil {
+		return err
+	}
+	str := `
+	INSERT INTO refresh_tokens
+		(user_id, device_id, family_id, session_id, token_hash, expires_on)
+		VALUES
+		(?, ?, ?, ?, ?, ?)
+	`
+	var sid db.NullInt64
+	if sessionid > 0 {
+		sid = db.NewNullInt64(sessionid)
+	}
+	_, err = ex.Exec(str, usr.UserID, deviceID, family, sid, token.Hash(refresh), exp)
+	if err != nil {
+		return err
+	}
+	usr.Token = tok
+	usr.RefreshToken = refresh
+	usr.ExpiresIn = int64(token.AccessTTL().Seconds())
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access and refresh token.
+// Presenting a token that was already rotated revokes every token in its family
+func RotateRefreshToken(st db.Storer, refresh, deviceID string) (*User, error) {
+	rt, err := getRefreshToken(st, token.Hash(refresh))
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if rt.RotatedOn.Valid {
+		if err := revokeStolenFamily(st, rt); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if rt.RevokedOn.Valid || time.Now().After(rt.ExpiresOn) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if deviceID != rt.DeviceID {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	usr, err := GetUserWithID(st, rt.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted {
+		return nil, ErrUserDeleted
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	str := `
+	UPDATE refresh_tokens
+	SET rotated_on = ?
+	WHERE refresh_token_id = ?
+	AND rotated_on IS NULL
+	AND revoked_on IS NULL
+	`
+	res, err := tx.Exec(str, time.Now(), rt.RefreshTokenID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		// Lost a race with another request presenting the same token
+		_ = tx.Rollback()
+		if err := revokeStolenFamily(st, rt); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	exp := time.Now().Add(token.RefreshTTL())
+	if rt.SessionID.Valid {
+		if err := refreshSession(tx, rt.SessionID.Int64, exp); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := issueTokens(tx, usr, rt.DeviceID, rt.FamilyID, rt.SessionID.Int64, exp); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return usr, tx.Commit()
+}
+
+// revokeStolenFamily revokes a reused refresh token's family and session,
+// one of the holders is not the user
+func revokeStolenFamily(ex db.Execer, rt *RefreshToken) error {
+	if err := RevokeRefreshFamily(ex, rt.FamilyID); err != nil {
+		return err
+	}
+	if !rt.SessionID.Valid {
+		return nil
+	}
+	return RevokeSession(ex, rt.UserID, rt.SessionID.Int64)
+}
+
+// RevokeRefreshFamily revokes every refresh token in a family
+func RevokeRefreshFamily(ex db.Execer, family string) error {
+	str := "UPDATE refresh_tokens SET revoked_on = ? WHERE family_id = ? AND revoked_on IS NULL"
+	_, err := ex.Exec(str, time.Now(), family)
+	return err
+}
+
+// Logout revokes the access token, its session and, if given, the refresh
+// token issued with it
+func Logout(ex db.Execer, claims *token.Claims, refresh string) error {
+	if err := token.Revoke(ex, claims); err != nil {
+		return err
+	}
+	if claims.SessionID > 0 {
+		if err := RevokeSession(ex, claims.UserID, claims.SessionID); err != nil {
+			return err
+		}
+	}
+	if refresh == "" {
+		return nil
+	}
+	str := `
+	UPDATE refresh_tokens r
+	INNER JOIN refresh_tokens f
+	ON f.family_id = r.family_id
+	SET f.revoked_on = ?
+	WHERE r.token_hash = ?
+	AND r.user_id = ?
+	AND f.revoked_on IS NULL
+	`
+	_, err := ex.Exec(str, time.Now(), token.Hash(refresh), claims.UserID)
+	return err
+}
+
+// RevokeAllTokens revokes every session, access and refresh token issued to
+// a user along with their api keys
+func RevokeAllTokens(ex db.Execer, userid int64) error {
+	if err := token.RevokeUser(ex, userid); err != nil {
+		return err
+	}
+	if err := revokeUserAPIKeys(ex, userid); err != nil {
+		return err
+	}
+	now := time.Now()
+	str := "UPDATE user_sessions SET revoked_on = ? WHERE user_id = ? AND revoked_on IS NULL"
+	if _, err := ex.Exec(str, now, userid); err != nil {
+		return err
+	}
+	str = "UPDATE refresh_tokens SET revoked_on = ? WHERE user_id = ? AND revoked_on IS NULL"
+	_, err := ex.Exec(str, now, userid)
+	return err
+}
+
+func getRefreshToken(qr db.Queryer, hash string) (*RefreshToken, error) {
+	str := "SELECT * FROM refresh_tokens WHERE token_hash = ?"
+	rt := RefreshToken{}
+	err := qr.Get(&rt, str, hash)
+	return &rt, err
+}
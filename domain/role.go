@@ -0,0 +1,174 @@
+package domain
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// ErrRoleNotGrantable is returned when a user grants a role with permissions they do not hold
+var ErrRoleNotGrantable = fmt.Errorf("Role has permissions you do not have")
+
+// ErrInvalidRole is returned when a role does not exist
+var ErrInvalidRole = fmt.Errorf("Invalid role")
+
+// ErrUserNotManageable is returned when a user changes a user holding
+// permissions they do not hold
+var ErrUserNotManageable = fmt.Errorf("User has permissions you do not have")
+
+// GetUserRoles returns the roles assigned to a user
+func GetUserRoles(qr db.Queryer, userid int64) ([]int64, error) {
+	str := "SELECT role_id FROM user_roles WHERE user_id = ? ORDER BY role_id"
+	roles := []int64{}
+	err := qr.Select(&roles, str, userid)
+	return roles, err
+}
+
+// GetUserPermissions returns the permissions granted to a user by their roles
+func GetUserPermissions(qr db.Queryer, userid int64) ([]int64, error) {
+	str := `
+	SELECT DISTINCT rp.permission_id
+	FROM user_roles ur
+	INNER JOIN role_permissions rp
+	ON rp.role_id = ur.role_id
+	WHERE ur.user_id = ?
+	ORDER BY rp.permission_id
+	`
+	perms := []int64{}
+	err := qr.Select(&perms, str, userid)
+	return perms, err
+}
+
+// GetRolePermissions returns the permissions granted by roles
+func GetRolePermissions(qr db.Queryer, roles ...int64) ([]int64, error) {
+	perms := []int64{}
+	if len(roles) == 0 {
+		return perms, nil
+	}
+	str, args, err := sqlx.In(`
+	SELECT DISTINCT permission_id
+	FROM role_permissions
+	WHERE role_id IN (?)
+	ORDER BY permission_id
+	`, roles)
+	if err != nil {
+		return nil, err
+	}
+	err = qr.Select(&perms, str, args...)
+	return perms, err
+}
+
+// HasPermissions returns true if have contains every permission in need
+func HasPermissions(have []int64, need ...int64) bool {
+	for _, n := range need {
+		found := false
+		for _, h := range have {
+			if h == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// AddUserRoles will assign roles to a user
+func AddUserRoles(ex db.Execer, userid int64, roles ...int64) error {
+	str := "INSERT IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)"
+	for _, r := range roles {
+		if _, err := ex.Exec(str, userid, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetUserRoles replaces a user's roles. grantor is the user making the change,
+// they must hold every permission the user has and may only grant roles whose
+// permissions they hold themselves
+func SetUserRoles(st db.Storer, grantor, userid int64, roles ...int64) error {
+	if err := CheckManageable(st, grantor, userid); err != nil {
+		return err
+	}
+	if err := checkGrantable(st, grantor, roles...); err != nil {
+		return err
+	}
+
+	tx, err := st.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", userid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := AddUserRoles(tx, userid, roles...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkGrantable returns ErrInvalidRole if a role does not exist and
+// ErrRoleNotGrantable unless grantor holds every permission of the roles
+func checkGrantable(qr db.Queryer, grantor int64, roles ...int64) error {
+	if err := checkRolesExist(qr, roles...); err != nil {
+		return err
+	}
+	have, err := GetUserPermissions(qr, grantor)
+	if err != nil {
+		return err
+	}
+	need, err := GetRolePermissions(qr, roles...)
+	if err != nil {
+		return err
+	}
+	if !HasPermissions(have, need...) {
+		return ErrRoleNotGrantable
+	}
+	return nil
+}
+
+// checkRolesExist returns ErrInvalidRole unless every role exists
+func checkRolesExist(qr db.Queryer, roles ...int64) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	distinct := map[int64]bool{}
+	for _, r := range roles {
+		distinct[r] = true
+	}
+	str, args, err := sqlx.In("SELECT count(*) FROM roles WHERE role_id IN (?)", roles)
+	if err != nil {
+		return err
+	}
+	cnt := 0
+	if err := qr.Get(&cnt, str, args...); err != nil {
+		return err
+	}
+	if cnt != len(distinct) {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+// CheckManageable returns ErrUserNotManageable unless grantor holds every
+// permission userid currently has
+func CheckManageable(qr db.Queryer, grantor, userid int64) error {
+	have, err := GetUserPermissions(qr, grantor)
+	if err != nil {
+		return err
+	}
+	need, err := GetUserPermissions(qr, userid)
+	if err != nil {
+		return err
+	}
+	if !HasPermissions(have, need...) {
+		return ErrUserNotManageable
+	}
+	return nil
+}
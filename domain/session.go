@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// ErrSessionRevoked is returned for a token whose session has been revoked
+var ErrSessionRevoked = fmt.Errorf("Session has been revoked")
+
+// maxUserAgent is the longest user agent stored, in characters
+const maxUserAgent = 512
+
+// MaxDeviceID is the longest device id that can be stored, in characters
+const MaxDeviceID = 255
+
+// Device identifies where a user logged in from
+type Device struct {
+	ID        string
+	UserAgent string
+	IP        string
+}
+
+// Session is a login on a device. Its access and refresh tokens are revoked with it
+type Session struct {
+	SessionID  int64       `db:"session_id" json:"session_id"`
+	UserID     int64       `db:"user_id" json:"user_id"`
+	DeviceID   string      `db:"device_id" json:"device_id"`
+	UserAgent  string      `db:"user_agent" json:"user_agent"`
+	IP         string      `db:"ip" json:"ip"`
+	CreatedOn  time.Time   `db:"created_on" json:"created_on"`
+	LastSeenOn time.Time   `db:"last_seen_on" json:"last_seen_on"`
+	ExpiresOn  time.Time   `db:"expires_on" json:"expires_on"`
+	RevokedOn  db.NullTime `db:"revoked_on" json:"revoked_on"`
+	Current    bool        `db:"-" json:"current"` // the session of the request
+}
+
+// GetUserSessions returns a user's active sessions, most recently seen first
+func GetUserSessions(qr db.Queryer, userid int64) ([]Session, error) {
+	str := `
+	SELECT * FROM user_sessions
+	WHERE user_id = ?
+	AND revoked_on IS NULL
+	AND expires_on > ?
+	ORDER BY last_seen_on DESC
+	`
+	sessions := []Session{}
+	err := qr.Select(&sessions, str, userid, time.Now())
+	return sessions, err
+}
+
+// RevokeSession revokes one of a user's sessions and its refresh tokens
+func RevokeSession(ex db.Execer, userid, sessionid int64) error {
+	now := time.Now()
+	str := "UPDATE user_sessions SET revoked_on = ? WHERE session_id = ? AND user_id = ? AND revoked_on IS NULL"
+	if _, err := ex.Exec(str, now, sessionid, userid); err != nil {
+		return err
+	}
+	str = "UPDATE refresh_tokens SET revoked_on = ? WHERE session_id = ? AND user_id = ? AND revoked_on IS NULL"
+	_, err := ex.Exec(str, now, sessionid, userid)
+	return err
+}
+
+// TouchSession returns ErrSessionRevoked if the session has been revoked,
+// otherwise it records the session was seen. Writes are throttled to one
+// every sessionTouchInterval
+func TouchSession(ex db.QueryExecer, userid, sessionid int64) error {
+	s := Session{}
+	str := "SELECT * FROM user_sessions WHERE session_id = ? AND user_id = ?"
+	err := ex.Get(&s, str, sessionid, userid)
+	if err == sql.ErrNoRows {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if s.RevokedOn.Valid || now.After(s.ExpiresOn) {
+		return ErrSessionRevoked
+	}
+	if now.Sub(s.LastSeenOn) < sessionTouchInterval {
+		return nil
+	}
+	str = "UPDATE user_sessions SET last_seen_on = ? WHERE session_id = ? AND last_seen_on < ?"
+	_, err = ex.Exec(str, now, sessionid, now.Add(-sessionTouchInterval))
+	return err
+}
+
+// createSession starts a session for a user on a device
+func createSession(ex db.Execer, userid int64, dev Device, expires time.Time) (int64, error) {
+	ua := truncate(dev.UserAgent, maxUserAgent)
+	now := time.Now()
+	str := `
+	INSERT INTO user_sessions
+		(user_id, device_id, user_agent, ip, created_on, last_seen_on, expires_on)
+		VALUES
+		(?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := ex.Exec(str, userid, dev.ID, ua, dev.IP, now, now, expires)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
+	}
+	return s
+}
+
+// refreshSession extends a session when its refresh token is rotated
+func refreshSession(ex db.Execer, sessionid int64, expires time.Time) error {
+	now := time.Now()
+	str := "UPDATE user_sessions SET last_seen_on = ?, expires_on = ? WHERE session_id = ?"
+	_, err := ex.Exec(str, now, expires, sessionid)
+	return err
+}
@@ -5,8 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-
-	"github.com/rajendraventurit/radicaapi/lib/db"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func genURLToken(val string, key []byte) string {
@@ -15,7 +16,6 @@ func genURLToken(val string, key []byte) string {
 	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-/*
 func verifyURLToken(val, tok string, key []byte) (bool, error) {
 	token, err := base64.URLEncoding.DecodeString(tok)
 	if err != nil {
@@ -28,34 +28,37 @@ func verifyURLToken(val, tok string, key []byte) (bool, error) {
 	}
 	return hmac.Equal(token, expected), nil
 }
-*/
 
-// genResetToken will return a reset token
-func genResetToken(qr db.Queryer, email string) ([]byte, error) {
-	user, err := GetUserWithEmail(qr, email)
-	if err != nil {
-		return nil, err
-	}
-	msg := fmt.Sprintf("%v:%v", user.UserID, email)
-	mac := hmac.New(sha256.New, []byte(resetKey))
-	_, err = mac.Write([]byte(msg))
-	return mac.Sum(nil), err
-}
+// errInvalidSignedToken is a malformed, tampered or expired signed token error
+var errInvalidSignedToken = fmt.Errorf("Invalid or expired token")
 
-// encodeResetToken returns a url encoded version of the reset token
-func encodeResetToken(tok []byte) string {
-	return base64.URLEncoding.EncodeToString(tok)
+// genSignedToken returns a url safe token carrying val which expires at exp
+func genSignedToken(val string, exp time.Time, key []byte) string {
+	msg := fmt.Sprintf("%v|%v", val, exp.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(msg)) + "." + genURLToken(msg, key)
 }
 
-// verifyResetToken will verify a reset token
-func verifyResetToken(qr db.Queryer, email, tok string) (bool, error) {
-	tokHMAC, err := base64.URLEncoding.DecodeString(tok)
-	if err != nil {
-		return false, err
+// verifySignedToken returns the value carried by a token from genSignedToken
+func verifySignedToken(tok string, key []byte) (string, error) {
+	parts := strings.SplitN(tok, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidSignedToken
 	}
-	expectedHMAC, err := genResetToken(qr, email)
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
 	if err != nil {
-		return false, err
+		return "", errInvalidSignedToken
+	}
+	msg := string(b)
+	if ok, err := verifyURLToken(msg, parts[1], key); err != nil || !ok {
+		return "", errInvalidSignedToken
+	}
+	i := strings.LastIndex(msg, "|")
+	if i < 0 {
+		return "", errInvalidSignedToken
+	}
+	exp, err := strconv.ParseInt(msg[i+1:], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", errInvalidSignedToken
 	}
-	return hmac.Equal(tokHMAC, expectedHMAC), nil
+	return msg[:i], nil
 }
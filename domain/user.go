@@ -1,18 +1,14 @@
 package domain
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"log"
-	"text/template"
+	"strings"
 	"time"
-	"unicode"
 
 	"github.com/rajendraventurit/radicaapi/lib/db"
-	"github.com/rajendraventurit/radicaapi/lib/smtp"
-	"github.com/rajendraventurit/radicaapi/lib/token"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/rajendraventurit/radicaapi/lib/password"
 )
 
 //Userpassword is an object of user password
@@ -49,19 +45,20 @@ type Stats struct {
 
 // CreateUser creates a user
 func CreateUser(ex db.Execer, fn, ln, email, pass string, roles ...int64) (*User, error) {
-	if err := validPassword(pass); err != nil {
-		return nil, err
-	}
 	u := NewUser(fn, ln, email)
-	hashed, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
-	if err != nil {
+	if err := GetPasswordPolicy().Check(pass, u); err != nil {
 		return nil, err
 	}
 	u.Password = pass
-	u.HashedPass = hashed
 
-	err = u.Create(ex)
-	return u, err
+	if err := u.Create(ex); err != nil {
+		return u, err
+	}
+	if len(roles) == 0 {
+		roles = []int64{RoleUser}
+	}
+	u.Roles = roles
+	return u, AddUserRoles(ex, u.UserID, roles...)
 }
 
 // CreateActivity creates activity of user
@@ -234,183 +231,127 @@ func UpdateUser(ex db.Execer, u User) error {
 	return u.Update(ex)
 }
 
-// MarkUserDeleted will mark a user deleted
+// MarkUserDeleted will mark a user deleted and revoke their tokens
 func MarkUserDeleted(ex db.Execer, userid int64) error {
-	str := "UPDATE users SET deleted = true WHERE user_id = ?"
-	_, err := ex.Exec(str, userid)
-	return err
+	str := "UPDATE users SET deleted = true, status = ? WHERE user_id = ?"
+	_, err := ex.Exec(str, StatusDeleted, userid)
+	if err != nil {
+		return err
+	}
+	return RevokeAllTokens(ex, userid)
 }
 
-// Authenticate returns true if email/password match
+// Authenticate returns the user if email/password match. Unknown emails take
+// as long as a wrong password. Use Login to throttle failed attempts and
+// IssueTokens to generate the user's tokens
 func Authenticate(st db.Storer, email, pass string) (*User, error) {
 	usr, err := GetUserWithEmail(st, email)
 	if err != nil {
+		compareDummy(pass)
+		return nil, err
+	}
+	hash := string(usr.HashedPass)
+	if err := password.Compare(hash, pass); err != nil {
 		return nil, err
 	}
 	if usr.Deleted {
 		return nil, ErrUserDeleted
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(usr.HashedPass), []byte(pass))
-	if err != nil {
-		return nil, err
-	}
-	tok, err := token.New(usr.UserID)
-	if err != nil {
-		return nil, err
+	if password.NeedsRehash(hash) {
+		// a failed rehash leaves the old hash, it is tried again next login
+		if hashed, err := rehashPassword(st, usr.UserID, hash, pass); err == nil {
+			usr.HashedPass = []byte(hashed)
+		}
 	}
-	usr.Token = tok
 	return usr, nil
 }
 
-// UpdatePassword updates a users password and writes original to the history table
-// It is independent of hashing and expects the password to be hashed
-func UpdatePassword(ex db.Execer, userid int64, pass string) error {
-	if err := validPassword(pass); err != nil {
+// ErrReauthFailed is returned when a user does not confirm their identity
+// before a destructive action
+var ErrReauthFailed = fmt.Errorf("Your password or two factor code is required")
+
+// Reauthenticate confirms a logged in user is present with their password or
+// a two factor code or recovery code, which is used up. Failed codes count as
+// they do at the login challenge and failed passwords as they do at login
+// from ip, so either locks the account when repeated
+func Reauthenticate(st db.Storer, userid int64, pass, code, ip string) error {
+	if strings.TrimSpace(code) != "" {
+		err := verifyMFACounted(st, userid, code)
+		if err == ErrMFANotEnabled || err == ErrInvalidMFACode {
+			return ErrReauthFailed
+		}
 		return err
 	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
-	if err != nil {
-		return err
+	if pass == "" {
+		return ErrReauthFailed
 	}
-	str := `
-	INSERT INTO user_passwords (user_id, password)
-	SELECT user_id, password FROM users WHERE user_id = ?
-	`
-	_, err = ex.Exec(str, userid)
+	usr, err := GetUserWithID(st, userid)
 	if err != nil {
 		return err
 	}
-
-	str = "UPDATE users SET password = ? WHERE user_id = ?"
-	_, err = ex.Exec(str, hashed, userid)
-	if err != nil {
+	now := time.Now()
+	if err := checkAccountLock(st, userid, now); err != nil {
 		return err
 	}
-	return nil
-}
-
-func validPassword(pass string) error {
-
-	var uppercasePresent bool
-	var lowercasePresent bool
-	var numberPresent bool
-	var specialCharPresent bool
-
-	var passLen int
-
-	for _, ch := range pass {
-
-		switch {
-		case unicode.IsNumber(ch):
-			numberPresent = true
-			passLen++
-		case unicode.IsUpper(ch):
-			uppercasePresent = true
-			passLen++
-		case unicode.IsLower(ch):
-			lowercasePresent = true
-			passLen++
-		case unicode.IsPunct(ch) || unicode.IsSymbol(ch):
-			specialCharPresent = true
-			passLen++
-		case ch == ' ':
-			passLen++
-		}
-	}
-
-	if !(minPassLength <= passLen && passLen <= maxPassLength) {
-		return fmt.Errorf(fmt.Sprintf("password length must be between %d to %d characters long", minPassLength, maxPassLength))
-	}
-	if !lowercasePresent {
-		return fmt.Errorf("lowercase letter missing")
+	if err := checkLogin(st, usr.Email, ip, now); err != nil {
+		return err
 	}
-	if !uppercasePresent {
-		return fmt.Errorf("uppercase letter missing")
+	ok := len(usr.HashedPass) > 0 && password.Compare(string(usr.HashedPass), pass) == nil
+	if len(usr.HashedPass) == 0 {
+		compareDummy(pass)
 	}
-	if !numberPresent {
-		return fmt.Errorf("atleast one numeric character required")
+	if err := recordLogin(st, usr.Email, ip, ok, now); err != nil {
+		return err
 	}
-	if !specialCharPresent {
-		return fmt.Errorf("special character missing")
+	if !ok {
+		return ErrReauthFailed
 	}
-
 	return nil
 }
 
-//Ispasswordmatchwithprevfivepass return true if the new password matches with previous five password.
-func Ispasswordmatchwithprevfivepass(qr db.Queryer, userid int64, pass string) bool {
-
-	sqlstr := `select user_password_id,user_id,password from user_passwords where user_id=? order by user_password_id limit 5`
-
-	passwords := []Userpassword{}
-	err := qr.Select(&passwords, sqlstr, userid)
-
-	fmt.Println("passwords", passwords)
-
-	fmt.Println("err", err)
-
+// rehashPassword replaces a hash made with old parameters. It does nothing
+// if the password was changed since old was read
+func rehashPassword(ex db.Execer, userid int64, old, pass string) (string, error) {
+	hashed, err := password.Hash(pass)
 	if err != nil {
-		log.Print("Ispasswordmatchwithprevfivepass", err)
-		return false
-	}
-
-	for _, password := range passwords {
-		err = bcrypt.CompareHashAndPassword([]byte(password.Password), []byte(pass))
-		if err == nil {
-			return true
-		}
+		return "", err
 	}
-
-	return false
+	str := "UPDATE users SET password = ? WHERE user_id = ? AND password = ?"
+	_, err = ex.Exec(str, hashed, userid, old)
+	return hashed, err
 }
 
-// SendResetToken will send a reset token to a user
-func SendResetToken(qr db.Queryer, email, resetURL string) error {
-	t, err := genResetToken(qr, email)
-	if err != nil {
+// UpdatePassword checks a new password against the password policy, writes
+// the original to the history table and updates the password
+func UpdatePassword(qe db.QueryExecer, userid int64, pass string) error {
+	if err := CheckPassword(qe, userid, pass); err != nil {
 		return err
 	}
-	tok := encodeResetToken(t)
-
-	rurl := fmt.Sprintf("%s?t=%s", resetURL, tok)
-	mailer := smtp.SMTP{}
+	return setPassword(qe, userid, pass)
+}
 
-	fname := fmt.Sprintf("%v/%v", defTemplatePath, "resetpass.html")
-	tmp, err := template.ParseFiles(fname)
+// setPassword updates a password without checking the policy
+func setPassword(ex db.Execer, userid int64, pass string) error {
+	hashed, err := password.Hash(pass)
 	if err != nil {
 		return err
 	}
-	p := struct {
-		Link string
-	}{Link: rurl}
-	var b bytes.Buffer
-	err = tmp.Execute(&b, p)
-	if err != nil {
-		return err
-	}
-	return mailer.Send("Password Reset", b.String(), nil, email)
-}
-
-// ResetPassword will reset a users password validated with token
-func ResetPassword(db db.Storer, email, tok, newpass string) error {
-	valid, err := verifyResetToken(db, email, tok)
+	now := time.Now()
+	str := `
+	INSERT INTO user_passwords (user_id, password, created_on)
+	SELECT user_id, password, ? FROM users WHERE user_id = ? AND password IS NOT NULL
+	`
+	_, err = ex.Exec(str, now, userid)
 	if err != nil {
 		return err
 	}
 
-	if !valid {
-		return fmt.Errorf("Invalid reset token")
-	}
-
-	user, err := GetUserWithEmail(db, email)
+	str = "UPDATE users SET password = ?, password_changed_on = ? WHERE user_id = ?"
+	_, err = ex.Exec(str, hashed, now, userid)
 	if err != nil {
 		return err
 	}
-	if Ispasswordmatchwithprevfivepass(db, user.UserID, newpass) {
-		return errors.New("History says that you have used this new password in the past")
-	}
-
-	return UpdatePassword(db, user.UserID, newpass)
+	return invalidateResetTokens(ex, userid, now)
 }
 
 // GetUser will return a user
@@ -420,10 +361,11 @@ func GetUser(qy db.Queryer, userid int64) (*User, error) {
 
 // UserList is a list of users
 type UserList struct {
-	Users  []User `json:"users"`
-	Total  int64  `json:"total"`
-	Offset int64  `json:"offset"`
-	Limit  int64  `json:"limit"`
+	Users      []User `json:"users"`
+	Total      int64  `json:"total"`
+	Offset     int64  `json:"offset"`
+	Limit      int64  `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"` // set when there are more users
 }
 
 // Password is a historical user password
@@ -453,14 +395,19 @@ type User struct {
 	FirstName    db.NullString `db:"first_name" json:"first_name"`
 	LastName     db.NullString `db:"last_name" json:"last_name"`
 	Email        string        `db:"email" json:"email"`
+	VerifiedOn   db.NullTime   `db:"email_verified_on" json:"email_verified_on"`
 	Password     string        `db:"-" json:"password,omitempty"`
 	HashedPass   []byte        `db:"password" json:"-"`
+	PassChanged  db.NullTime   `db:"password_changed_on" json:"password_changed_on"`
 	CreatedOn    time.Time     `db:"created_on" json:"created_on"`
 	UpdatedOn    time.Time     `db:"updated_on" json:"updated_on"`
 	Deleted      bool          `db:"deleted" json:"deleted"`
 	Token        string        `db:"-" json:"token,omitempty"`
+	RefreshToken string        `db:"-" json:"refresh_token,omitempty"`
+	ExpiresIn    int64         `db:"-" json:"expires_in,omitempty"`
 	RolesStr     string        `db:"roles_str" json:"-"`
-	Status       string        `json:"status"`
+	Roles        []int64       `db:"-" json:"roles"`
+	Status       UserStatus    `db:"status" json:"status"`
 	UserDiseases []UserDisease `json:"user_diseases"`
 }
 
@@ -505,21 +452,21 @@ var ErrUserDeleted = fmt.Errorf("User has been deleted")
 func (u *User) Create(ex db.Execer) error {
 	str := `
 	INSERT INTO users
-		(first_name, last_name, email, password)
+		(first_name, last_name, email, password, password_changed_on, status)
 		VALUES
-		(:first_name, :last_name, :email, :password)
+		(:first_name, :last_name, :email, :password, :password_changed_on, :status)
 	`
-	unhashed := u.Password
-	hashed, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	u.PassChanged = db.NewNullTime(time.Now())
+	u.Status = StatusActive
+	hashed, err := password.Hash(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashed)
+	u.HashedPass = []byte(hashed)
 	resp, err := ex.NamedExec(str, u)
 	if err != nil {
 		return err
 	}
-	u.Password = unhashed
 	id, err := resp.LastInsertId()
 	if err != nil {
 		return err
@@ -543,6 +490,11 @@ func (u User) Update(ex db.Execer) error {
 	return err
 }
 
+// Verified returns true if the user has verified their email
+func (u User) Verified() bool {
+	return u.VerifiedOn.Valid
+}
+
 // IsUserDeleted returns true if user has been deleted
 func IsUserDeleted(qr db.Queryer, userid int64) bool {
 	str := "SELECT deleted FROM users WHERE user_id = ?"
@@ -571,6 +523,12 @@ func GetUserWithID(qr db.Queryer, userid int64) (*User, error) {
 
 	user.UserDiseases = diseases
 
+	roles, err := GetUserRoles(qr, user.UserID)
+	if err != nil {
+		return &user, err
+	}
+	user.Roles = roles
+
 	return &user, nil
 }
 
@@ -591,6 +549,12 @@ func GetUserWithEmail(qr db.Queryer, email string) (*User, error) {
 
 	user.UserDiseases = diseases
 
+	roles, err := GetUserRoles(qr, user.UserID)
+	if err != nil {
+		return &user, err
+	}
+	user.Roles = roles
+
 	return &user, err
 }
 
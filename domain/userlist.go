@@ -0,0 +1,194 @@
+package domain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// ErrInvalidSort is an unknown sort error
+var ErrInvalidSort = fmt.Errorf("Invalid sort")
+
+// ErrInvalidCursor is a malformed cursor or one from a different sort
+var ErrInvalidCursor = fmt.Errorf("Invalid cursor")
+
+// UserFilter selects users for ListUsers. Zero values do not filter
+type UserFilter struct {
+	Search        string      // matched against first name, last name and email
+	Status        *UserStatus // deleted users are excluded unless requested
+	RoleID        int64
+	DiseaseID     int64
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Sort          string // a userSorts key, prefix with - to sort descending
+	Offset        int64
+	Limit         int64
+	Cursor        string // continues from a NextCursor, Offset is ignored
+}
+
+// userSort is a sortable user column. val returns the cursor value of a user
+type userSort struct {
+	col string
+	val func(u User) string
+}
+
+// userSorts are the columns users may be sorted by
+var userSorts = map[string]userSort{
+	"user_id":    {"u.user_id", func(u User) string { return strconv.FormatInt(u.UserID, 10) }},
+	"email":      {"u.email", func(u User) string { return u.Email }},
+	"first_name": {"COALESCE(u.first_name, '')", func(u User) string { return u.FirstName.String }},
+	"last_name":  {"COALESCE(u.last_name, '')", func(u User) string { return u.LastName.String }},
+	"created_on": {"u.created_on", func(u User) string { return u.CreatedOn.UTC().Format(time.RFC3339Nano) }},
+}
+
+// userCursor is the position after the last user of a page
+type userCursor struct {
+	Sort   string `json:"s"`
+	Value  string `json:"v"`
+	UserID int64  `json:"id"`
+}
+
+// ListUsers returns a page of users matching the filter and the total that match
+func ListUsers(qr db.Queryer, f UserFilter) (*UserList, error) {
+	if f.Sort == "" {
+		f.Sort = "user_id"
+	}
+	desc := strings.HasPrefix(f.Sort, "-")
+	sort, ok := userSorts[strings.TrimPrefix(f.Sort, "-")]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+	if f.Limit < 1 {
+		f.Limit = defUserListLimit
+	}
+	if f.Limit > maxUserListLimit {
+		f.Limit = maxUserListLimit
+	}
+	if f.Offset < 0 || f.Cursor != "" {
+		f.Offset = 0
+	}
+
+	where, args := f.where()
+	list := UserList{Users: []User{}, Offset: f.Offset, Limit: f.Limit}
+	str := "SELECT count(*) FROM users u WHERE " + strings.Join(where, " AND ")
+	if err := qr.Get(&list.Total, str, args...); err != nil {
+		return nil, err
+	}
+
+	if f.Cursor != "" {
+		c, err := decodeUserCursor(f.Cursor, f.Sort)
+		if err != nil {
+			return nil, err
+		}
+		var val interface{} = c.Value
+		if sort.col == "u.created_on" {
+			if val, err = time.Parse(time.RFC3339Nano, c.Value); err != nil {
+				return nil, ErrInvalidCursor
+			}
+		}
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND u.user_id %[2]s ?))", sort.col, op))
+		args = append(args, val, val, c.UserID)
+	}
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+	str = fmt.Sprintf(`
+	SELECT u.*,
+		COALESCE((SELECT GROUP_CONCAT(ur.role_id ORDER BY ur.role_id) FROM user_roles ur WHERE ur.user_id = u.user_id), '') AS roles_str
+	FROM users u
+	WHERE %s
+	ORDER BY %s %s, u.user_id %s
+	LIMIT ? OFFSET ?
+	`, strings.Join(where, " AND "), sort.col, dir, dir)
+	// one extra row tells if there is another page
+	args = append(args, f.Limit+1, f.Offset)
+	if err := qr.Select(&list.Users, str, args...); err != nil {
+		return nil, err
+	}
+	if int64(len(list.Users)) > f.Limit {
+		list.Users = list.Users[:f.Limit]
+		last := list.Users[len(list.Users)-1]
+		list.NextCursor = encodeUserCursor(userCursor{Sort: f.Sort, Value: sort.val(last), UserID: last.UserID})
+	}
+	for i := range list.Users {
+		list.Users[i].Roles = parseRoles(list.Users[i].RolesStr)
+	}
+	return &list, nil
+}
+
+// where returns the filter's conditions and their arguments
+func (f UserFilter) where() ([]string, []interface{}) {
+	where := []string{}
+	args := []interface{}{}
+	if f.Status != nil {
+		where = append(where, "u.status = ?")
+		args = append(args, *f.Status)
+	} else {
+		where = append(where, "u.status != ?")
+		args = append(args, StatusDeleted)
+	}
+	if s := strings.TrimSpace(f.Search); s != "" {
+		like := "%" + escapeLike(s) + "%"
+		where = append(where, "(u.first_name LIKE ? OR u.last_name LIKE ? OR u.email LIKE ? OR CONCAT_WS(' ', u.first_name, u.last_name) LIKE ?)")
+		args = append(args, like, like, like, like)
+	}
+	if f.RoleID > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.user_id AND ur.role_id = ?)")
+		args = append(args, f.RoleID)
+	}
+	if f.DiseaseID > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM user_disease ud WHERE ud.user_id = u.user_id AND ud.disease_id = ? AND ud.deleted = false)")
+		args = append(args, f.DiseaseID)
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "u.created_on >= ?")
+		args = append(args, *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "u.created_on < ?")
+		args = append(args, *f.CreatedBefore)
+	}
+	return where, args
+}
+
+func encodeUserCursor(c userCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s, sort string) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := userCursor{}
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func parseRoles(str string) []int64 {
+	roles := []int64{}
+	for _, s := range strings.Split(str, ",") {
+		if r, err := strconv.ParseInt(s, 10, 64); err == nil {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+	"github.com/rajendraventurit/radicaapi/lib/smtp"
+)
+
+// ErrEmailNotVerified is returned when an unverified user is refused by the verification policy
+var ErrEmailNotVerified = fmt.Errorf("Email address has not been verified")
+
+// ErrInvalidVerifyToken is an invalid or expired verification link error
+var ErrInvalidVerifyToken = fmt.Errorf("Invalid or expired verification link")
+
+// UnverifiedAllowed returns true if the verification policy lets unverified
+// users use a route. allowUnverified is the route's own setting
+func UnverifiedAllowed(allowUnverified bool) bool {
+	switch UnverifiedPolicy() {
+	case VerifyPolicyAllow:
+		return true
+	case VerifyPolicyRestricted:
+		return allowUnverified
+	}
+	return false
+}
+
+// IsEmailVerified returns true if the user has verified their email
+func IsEmailVerified(qr db.Queryer, userid int64) (bool, error) {
+	str := "SELECT email_verified_on FROM users WHERE user_id = ?"
+	var on db.NullTime
+	err := qr.Get(&on, str, userid)
+	return on.Valid, err
+}
+
+// SendVerification will email a user a signed link to verify their email.
+// The link is invalidated if the user's email changes
+func SendVerification(usr *User) error {
+	conf := localConf.Verification
+	if conf.URL == "" {
+		return fmt.Errorf("verification url not configured")
+	}
+	exp := time.Now().Add(time.Duration(conf.ExpireHours) * time.Hour)
+	key, err := signingKey(conf.Secret, verifyPurpose)
+	if err != nil {
+		return err
+	}
+	tok := genSignedToken(fmt.Sprintf("%v:%v", usr.UserID, usr.Email), exp, key)
+	vurl := fmt.Sprintf("%s?t=%s", conf.URL, url.QueryEscape(tok))
+
+	fname := fmt.Sprintf("%v/%v", defTemplatePath, "verify.html")
+	tmp, err := template.ParseFiles(fname)
+	if err != nil {
+		return err
+	}
+	p := struct {
+		Link  string
+		Hours int
+	}{Link: vurl, Hours: conf.ExpireHours}
+	var b bytes.Buffer
+	if err := tmp.Execute(&b, p); err != nil {
+		return err
+	}
+	mailer := smtp.SMTP{}
+	return mailer.Send("Verify your email", b.String(), nil, usr.Email)
+}
+
+// ResendVerification will send a new verification link. Unknown, deleted and
+// verified emails are ignored so callers can not discover accounts
+func ResendVerification(qr db.Queryer, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	usr, err := GetUserWithEmail(qr, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if usr.Deleted || usr.Verified() {
+		return nil
+	}
+	return SendVerification(usr)
+}
+
+// VerifyEmail marks the user in a verification link verified
+func VerifyEmail(st db.Storer, tok string) (*User, error) {
+	key, err := signingKey(localConf.Verification.Secret, verifyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	val, err := verifySignedToken(tok, key)
+	if err != nil {
+		return nil, ErrInvalidVerifyToken
+	}
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidVerifyToken
+	}
+	userid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidVerifyToken
+	}
+	usr, err := GetUserWithID(st, userid)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidVerifyToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usr.Deleted || !strings.EqualFold(usr.Email, parts[1]) {
+		return nil, ErrInvalidVerifyToken
+	}
+	if usr.Verified() {
+		return usr, nil
+	}
+
+	now := time.Now()
+	str := "UPDATE users SET email_verified_on = ? WHERE user_id = ? AND email_verified_on IS NULL"
+	if _, err := st.Exec(str, now, userid); err != nil {
+		return nil, err
+	}
+	usr.VerifiedOn = db.NewNullTime(now)
+	return usr, nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// APIKeyRoutes returns the api key routes
+func APIKeyRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:    "API Key",
+		Name:        "Create API key",
+		Description: "Creates an API key for an external process. The key is only returned once. user_id defaults to the caller and must be an active user whose permissions the caller holds",
+		Method:      "POST",
+		Input:       `{"name": "reporting", "user_id": 1, "scopes": ["disease:read"], "expires_on": "2020-01-01T00:00:00Z"}`,
+		Output:      `{"api_key_id": 1, "user_id": 1, "name": "reporting", "prefix": "1a2b3c4d", "scopes": ["disease:read"], "expires_on": null, "key": "rk_1a2b3c4d_abc"}`,
+		Path:        "/api/v1/apikey",
+		Handler:     handler.AuthHandler{Env: env, Fn: HandleCreateAPIKey},
+		Sensitive:   true,
+		Permissions: []int64{domain.PermManageUsers},
+	},
+		routetable.Route{
+			Category:    "API Key",
+			Name:        "List API keys",
+			Method:      "GET",
+			Output:      `[{"api_key_id": 1, "user_id": 1, "name": "reporting", "prefix": "1a2b3c4d", "scopes": ["disease:read"], "expires_on": null, "revoked_on": null, "last_used_on": null}]`,
+			Path:        "/api/v1/apikeys",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetAPIKeys},
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "API Key",
+			Name:        "Revoke API key",
+			Method:      "DELETE",
+			Input:       `{"api_key_id": 1}`,
+			Path:        "/api/v1/apikey",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleRevokeAPIKey},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+	)
+	return rt
+}
+
+// HandleCreateAPIKey will create an api key
+func HandleCreateAPIKey(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		Name      string     `json:"name"`
+		UserID    int64      `json:"user_id"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresOn *time.Time `json:"expires_on"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if in.UserID == 0 {
+		in.UserID = p.UserID
+	}
+	if in.ExpiresOn != nil && in.ExpiresOn.Before(time.Now()) {
+		return serror.NewBadRequest(fmt.Errorf("expires_on in the past"), "HandleCreateAPIKey", "expires_on must be in the future")
+	}
+	key, err := domain.CreateAPIKey(env.DB, p.UserID, in.UserID, in.Name, in.Scopes, in.ExpiresOn)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return serror.NewBadRequest(err, "domain.CreateAPIKey", "invalid user_id")
+	case domain.ErrUserNotManageable:
+		return serror.New(http.StatusForbidden, err, "domain.CreateAPIKey", err.Error())
+	default:
+		return serror.NewBadRequest(err, "domain.CreateAPIKey", err.Error())
+	}
+	return sendJSON(w, key)
+}
+
+// HandleGetAPIKeys will list api keys
+func HandleGetAPIKeys(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	keys, err := domain.GetAPIKeys(env.DB)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetAPIKeys")
+	}
+	return sendJSON(w, keys)
+}
+
+// HandleRevokeAPIKey will revoke an api key
+func HandleRevokeAPIKey(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		APIKeyID int64 `json:"api_key_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if in.APIKeyID == 0 {
+		return serror.NewBadRequest(fmt.Errorf("Invalid api_key_id"), "HandleRevokeAPIKey", "invalid api_key_id")
+	}
+	if err := domain.RevokeAPIKey(env.DB, in.APIKeyID); err != nil {
+		return serror.NewServer(err, "domain.RevokeAPIKey")
+	}
+	return nil
+}
@@ -10,6 +10,14 @@ func GetRoutes(env *env.Env) routetable.RouteTable {
 	rt := routetable.NewRouteTable()
 	rt.Combine(
 		UserRoutes(env),
+		APIKeyRoutes(env),
+		MFARoutes(env),
+		OIDCRoutes(env),
+		SessionRoutes(env),
+		InviteRoutes(env),
+		OrganizationRoutes(env),
+		PrivacyRoutes(env),
+		ImpersonationRoutes(env),
 	)
 	return rt
 }
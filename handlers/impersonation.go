@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// ImpersonationRoutes returns the admin impersonation routes
+func ImpersonationRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:    "Impersonation",
+		Name:        "Impersonate user",
+		Description: "Returns a short lived token to act as a user. The caller must hold every permission of the user. Each request made with the token is recorded and sensitive routes are refused",
+		Method:      "POST",
+		Input:       `{"user_id": 2, "reason": "support ticket 1234"}`,
+		Output:      `{"impersonation_id": 1, "actor_id": 1, "user_id": 2, "reason": "support ticket 1234", "expires_on": "", "ended_on": null, "created_on": "", "token": "", "expires_in": 900}`,
+		Path:        "/api/v1/impersonate",
+		Handler:     handler.AuthHandler{Env: env, Fn: HandleStartImpersonation},
+		Permissions: []int64{domain.PermManageUsers},
+		Sensitive:   true,
+	},
+		routetable.Route{
+			Category:        "Impersonation",
+			Name:            "End impersonation",
+			Description:     "Ends the impersonation of the request's token",
+			Method:          "DELETE",
+			Path:            "/api/v1/impersonate",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleEndImpersonation},
+			AllowUnverified: true,
+		},
+		routetable.Route{
+			Category:    "Impersonation",
+			Name:        "List impersonations",
+			Method:      "GET",
+			Output:      `[{"impersonation_id": 1, "actor_id": 1, "user_id": 2, "reason": "support ticket 1234", "expires_on": "", "ended_on": null, "created_on": ""}]`,
+			Path:        "/api/v1/impersonations",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetImpersonations},
+			Permissions: []int64{domain.PermManageUsers},
+			Sensitive:   true,
+		},
+		routetable.Route{
+			Category:    "Impersonation",
+			Name:        "Impersonation requests",
+			Description: "Returns the requests made during an impersonation",
+			Method:      "GET",
+			Input:       `impersonation_id=1`,
+			Output:      `[{"impersonation_request_id": 1, "impersonation_id": 1, "method": "GET", "path": "/api/v1/user", "created_on": ""}]`,
+			Path:        "/api/v1/impersonation/requests",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetImpersonationRequests},
+			Permissions: []int64{domain.PermManageUsers},
+			Sensitive:   true,
+		},
+	)
+	return rt
+}
+
+// HandleStartImpersonation will issue an impersonation token
+func HandleStartImpersonation(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID int64  `json:"user_id"`
+		Reason string `json:"reason"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	imp, err := domain.StartImpersonation(env.DB, p.UserID, in.UserID, in.Reason)
+	switch err {
+	case nil:
+	case domain.ErrReasonRequired:
+		return serror.NewBadRequest(err, "domain.StartImpersonation", err.Error())
+	case sql.ErrNoRows:
+		return serror.NewBadRequest(err, "domain.StartImpersonation", "invalid user_id")
+	case domain.ErrCannotImpersonate:
+		return serror.New(http.StatusForbidden, fmt.Errorf("UserID %v may not impersonate user %v", p.UserID, in.UserID), "domain.StartImpersonation", err.Error())
+	default:
+		return serror.NewServer(err, "domain.StartImpersonation")
+	}
+	return sendJSON(w, imp)
+}
+
+// HandleEndImpersonation will end the impersonation of the request's token
+func HandleEndImpersonation(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	if p.ActorID == 0 || p.Claims == nil {
+		return serror.NewBadRequest(fmt.Errorf("UserID %v is not impersonating", p.UserID), "HandleEndImpersonation", "not impersonating")
+	}
+	if err := domain.EndImpersonation(env.DB, p.Claims); err != nil {
+		return serror.NewServer(err, "domain.EndImpersonation")
+	}
+	return sendJSON1(w, "", true, "Impersonation ended", http.StatusOK)
+}
+
+// HandleGetImpersonations will list impersonations
+func HandleGetImpersonations(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	imps, err := domain.GetImpersonations(env.DB)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetImpersonations")
+	}
+	return sendJSON(w, imps)
+}
+
+// HandleGetImpersonationRequests will list the requests of an impersonation
+func HandleGetImpersonationRequests(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	id, err := getQueryInt64(r, "impersonation_id")
+	if err != nil {
+		return err
+	}
+	reqs, err := domain.GetImpersonationRequests(env.DB, id)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetImpersonationRequests")
+	}
+	return sendJSON(w, reqs)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// InviteRoutes returns the invite routes
+func InviteRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:    "Invite",
+		Name:        "Invite user",
+		Description: "Creates a pending user with roles and emails them a link to set their password. roles defaults to User",
+		Method:      "POST",
+		Input:       `{"first_name": "John", "last_name": "Doe", "email": "jdoe@somewhere.com", "roles": [1]}`,
+		Output:      `{"invite_id": 1, "user_id": 2, "email": "jdoe@somewhere.com", "invited_by": 1, "sent_on": "", "expires_on": "", "accepted_on": null, "cancelled_on": null, "created_on": ""}`,
+		Path:        "/api/v1/invite",
+		Handler:     handler.AuthHandler{Env: env, Fn: HandleInviteUser},
+		Sensitive:   true,
+		Permissions: []int64{domain.PermManageUsers},
+	},
+		routetable.Route{
+			Category:    "Invite",
+			Name:        "List pending invites",
+			Method:      "GET",
+			Output:      `[{"invite_id": 1, "user_id": 2, "email": "jdoe@somewhere.com", "invited_by": 1, "sent_on": "", "expires_on": "", "accepted_on": null, "cancelled_on": null, "created_on": ""}]`,
+			Path:        "/api/v1/invites",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetInvites},
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "Invite",
+			Name:        "Resend invite",
+			Description: "Emails a new invite link with a new expiry. Earlier links stop working",
+			Method:      "POST",
+			Input:       `{"invite_id": 1}`,
+			Path:        "/api/v1/invite/resend",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleResendInvite},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "Invite",
+			Name:        "Cancel invite",
+			Description: "Cancels a pending invite and removes the pending user",
+			Method:      "DELETE",
+			Input:       `{"invite_id": 1}`,
+			Path:        "/api/v1/invite",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleCancelInvite},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "Invite",
+			Name:        "Accept invite",
+			Description: "Sets the invited user's password from the emailed token and returns a token the same as User login",
+			Method:      "POST",
+			Input:       `{"token": "abc", "password": "Secret123!", "device_id": "2fc4b5912826ad1"}`,
+			Output:      `{"user_id": 0, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+			Path:        "/api/v1/invite/accept",
+			Handler:     handler.Handler{Env: env, Fn: HandleAcceptInvite},
+			Insecure:    true,
+		},
+	)
+	return rt
+}
+
+// HandleInviteUser will invite a user by email
+func HandleInviteUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		FirstName string  `json:"first_name"`
+		LastName  string  `json:"last_name"`
+		Email     string  `json:"email"`
+		Roles     []int64 `json:"roles"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if in.FirstName == "" && in.LastName == "" {
+		return serror.NewBadRequest(fmt.Errorf("first / last name required"), "HandleInviteUser", "first / last name required")
+	}
+	inv, err := domain.InviteUser(env.DB, p.UserID, in.FirstName, in.LastName, in.Email, in.Roles...)
+	switch {
+	case err == nil:
+	case inv != nil:
+		// the invite exists, it can be resent
+		logger.ErrorfContext(r.Context(), "domain.InviteUser send invite %v %v", inv.InviteID, err)
+	case err == domain.ErrRoleNotGrantable:
+		return serror.New(http.StatusForbidden, err, "domain.InviteUser", err.Error())
+	default:
+		return serror.NewBadRequest(err, "domain.InviteUser", err.Error())
+	}
+	return sendJSON(w, inv)
+}
+
+// HandleGetInvites will list pending invites
+func HandleGetInvites(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	invites, err := domain.GetPendingInvites(env.DB)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetPendingInvites")
+	}
+	return sendJSON(w, invites)
+}
+
+// HandleResendInvite will resend a pending invite
+func HandleResendInvite(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		InviteID int64 `json:"invite_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.ResendInvite(env.DB, in.InviteID)
+	if err == domain.ErrInvalidInvite {
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.ResendInvite")
+	}
+	return sendJSON1(w, "", true, "Invite has been sent", http.StatusOK)
+}
+
+// HandleCancelInvite will cancel a pending invite
+func HandleCancelInvite(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		InviteID int64 `json:"invite_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.CancelInvite(env.DB, in.InviteID)
+	if err == domain.ErrInvalidInvite {
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.CancelInvite")
+	}
+	return sendJSON1(w, "", true, "Invite cancelled", http.StatusOK)
+}
+
+// HandleAcceptInvite will set an invited user's password and log them in
+func HandleAcceptInvite(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+		DeviceID string `json:"device_id"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
+	}
+	user, err := domain.AcceptInvite(env.DB, p.Token, p.Password)
+	if perr, ok := err.(domain.PasswordError); ok {
+		return sendJSON1(w, perr, false, perr.Error(), http.StatusBadRequest)
+	}
+	if err == domain.ErrInvalidInvite {
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.AcceptInvite")
+	}
+	return completeLogin(env, w, user, dev)
+}
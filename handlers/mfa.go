@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/ratelimit"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// MFARoutes returns the two factor authentication routes
+func MFARoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:    "Two Factor",
+		Name:        "Two factor login",
+		Description: "Exchanges the mfa_token from login and a TOTP or recovery code for a token",
+		Method:      "POST",
+		Input:       `{"mfa_token": "abc", "code": "123456", "device_id": "2fc4b5912826ad1"}`,
+		Output:      `{"user_id": 0, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+		Path:        "/api/v1/user/login/mfa",
+		Handler:     handler.Handler{Env: env, Fn: HandleMFALogin},
+		RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 60, Burst: 5},
+		Insecure:    true,
+	},
+		routetable.Route{
+			Category:    "Two Factor",
+			Name:        "Enroll two factor",
+			Description: "Starts TOTP enrollment. Render uri as a QR code for authenticator apps",
+			Method:      "POST",
+			Output:      `{"secret": "ABC", "uri": "otpauth://totp/Radica:name?secret=ABC&issuer=Radica"}`,
+			Path:        "/api/v1/user/mfa/enroll",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleEnrollMFA},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:    "Two Factor",
+			Name:        "Confirm two factor",
+			Description: "Enables two factor authentication and returns recovery codes. Recovery codes are only shown once",
+			Method:      "POST",
+			Input:       `{"code": "123456"}`,
+			Output:      `{"recovery_codes": ["abcde-fghij"]}`,
+			Path:        "/api/v1/user/mfa/confirm",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleConfirmMFA},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:    "Two Factor",
+			Name:        "Disable two factor",
+			Description: "Turns off two factor authentication with a code or recovery code. Failed codes count towards locking the account",
+			Method:      "DELETE",
+			Input:       `{"code": "123456"}`,
+			Path:        "/api/v1/user/mfa",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleDisableMFA},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+	)
+	return rt
+}
+
+// HandleMFALogin will complete a login with a two factor code
+func HandleMFALogin(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+		DeviceID string `json:"device_id"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	claims, err := token.DecodeChallenge(p.MFAToken, token.PurposeMFA)
+	if err != nil {
+		return sendJSON1(w, "", false, "Invalid or expired mfa_token", http.StatusUnauthorized)
+	}
+	revoked, err := token.IsRevoked(env.DB, claims)
+	if err != nil {
+		return serror.NewServer(err, "token.IsRevoked")
+	}
+	if revoked {
+		return sendJSON1(w, "", false, "Invalid or expired mfa_token", http.StatusUnauthorized)
+	}
+	err = domain.VerifyMFALogin(env.DB, claims.UserID, time.Unix(claims.IssuedAt, 0), p.Code)
+	if te, ok := err.(domain.LoginThrottledError); ok {
+		if rerr := token.Revoke(env.DB, claims); rerr != nil {
+			return serror.NewServer(rerr, "token.Revoke")
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(te.RetryAfter.Seconds()+1)))
+		return sendJSON1(w, "", false, te.Error(), http.StatusTooManyRequests)
+	}
+	switch err {
+	case nil:
+	case domain.ErrMFAChallengeFailed:
+		if rerr := token.Revoke(env.DB, claims); rerr != nil {
+			return serror.NewServer(rerr, "token.Revoke")
+		}
+		return sendJSON1(w, "", false, err.Error(), http.StatusUnauthorized)
+	case domain.ErrInvalidMFACode, domain.ErrMFANotEnabled:
+		return sendJSON1(w, "", false, err.Error(), http.StatusUnauthorized)
+	default:
+		return serror.NewServer(err, "domain.VerifyMFALogin")
+	}
+	// the challenge is single use
+	if err := token.Revoke(env.DB, claims); err != nil {
+		return serror.NewServer(err, "token.Revoke")
+	}
+
+	user, err := domain.GetUserWithID(env.DB, claims.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserWithID")
+	}
+	if user.Deleted {
+		return sendJSON1(w, "", false, domain.ErrUserDeleted.Error(), http.StatusUnauthorized)
+	}
+	return finishLogin(env, w, user, dev)
+}
+
+// HandleEnrollMFA will start two factor enrollment
+func HandleEnrollMFA(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	user, err := domain.GetUserWithID(env.DB, p.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserWithID")
+	}
+	enr, err := domain.EnrollMFA(env.DB, user)
+	if err == domain.ErrMFAEnabled {
+		return serror.NewBadRequest(err, "domain.EnrollMFA", err.Error())
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.EnrollMFA")
+	}
+	return sendJSON(w, enr)
+}
+
+// HandleConfirmMFA will enable two factor authentication
+func HandleConfirmMFA(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		Code string `json:"code"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	codes, err := domain.ConfirmMFA(env.DB, p.UserID, in.Code)
+	switch err {
+	case nil:
+	case domain.ErrInvalidMFACode, domain.ErrMFAEnabled, domain.ErrMFANotEnabled:
+		return serror.NewBadRequest(err, "domain.ConfirmMFA", err.Error())
+	default:
+		return serror.NewServer(err, "domain.ConfirmMFA")
+	}
+	out := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes}
+	return sendJSON(w, out)
+}
+
+// HandleDisableMFA will disable two factor authentication
+func HandleDisableMFA(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		Code string `json:"code"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.DisableMFA(env.DB, p.UserID, in.Code)
+	if te, ok := err.(domain.LoginThrottledError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(te.RetryAfter.Seconds()+1)))
+		return sendJSON1(w, "", false, te.Error(), http.StatusTooManyRequests)
+	}
+	switch err {
+	case nil:
+	case domain.ErrInvalidMFACode, domain.ErrMFANotEnabled:
+		return serror.NewBadRequest(err, "domain.DisableMFA", err.Error())
+	default:
+		return serror.NewServer(err, "domain.DisableMFA")
+	}
+	return nil
+}
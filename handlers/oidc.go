@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/oidc"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// oidcCookie holds the binding of the identity provider login the browser
+// started. Only that browser can complete it
+const oidcCookie = "radica_oidc"
+
+// OIDCRoutes returns the identity provider login routes
+func OIDCRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category: "Identity Providers",
+		Name:     "List identity providers",
+		Method:   "GET",
+		Output:   `{"providers": ["google"]}`,
+		Path:     "/api/v1/oidc/providers",
+		Handler:  handler.Handler{Env: env, Fn: HandleGetOIDCProviders},
+		Insecure: true,
+	},
+		routetable.Route{
+			Category:    "Identity Providers",
+			Name:        "Start identity provider login",
+			Description: "Returns the provider url to send the user to and sets a cookie binding the login to the browser. The provider redirects back to the provider's redirect_url with code and state for the callback",
+			Method:      "POST",
+			Input:       `{"provider": "google"}`,
+			Output:      `{"auth_url": "https://accounts.google.com/o/oauth2/v2/auth?..."}`,
+			Path:        "/api/v1/oidc/start",
+			Handler:     handler.Handler{Env: env, Fn: HandleStartOIDCLogin},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "Identity Providers",
+			Name:        "Identity provider callback",
+			Description: "Completes an identity provider login or link and returns a token the same as User login. It must be sent with the cookie set when the login was started",
+			Method:      "POST",
+			Input:       `{"provider": "google", "state": "abc", "code": "abc", "device_id": "2fc4b5912826ad1"}`,
+			Output:      `{"user_id": 0, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+			Path:        "/api/v1/oidc/callback",
+			Handler:     handler.Handler{Env: env, Fn: HandleOIDCCallback},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "Identity Providers",
+			Name:        "Link identity provider",
+			Description: "Starts a login that links the provider identity to the logged in user",
+			Method:      "POST",
+			Input:       `{"provider": "google"}`,
+			Output:      `{"auth_url": "https://accounts.google.com/o/oauth2/v2/auth?..."}`,
+			Path:        "/api/v1/oidc/link",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleLinkOIDC},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:    "Identity Providers",
+			Name:        "Linked identities",
+			Method:      "GET",
+			Output:      `[{"user_identity_id": 1, "user_id": 1, "provider": "google", "subject": "abc", "email": "", "created_on": "", "last_login_on": ""}]`,
+			Path:        "/api/v1/user/identities",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetUserIdentities},
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:    "Identity Providers",
+			Name:        "Unlink identity",
+			Method:      "DELETE",
+			Input:       `{"user_identity_id": 1}`,
+			Path:        "/api/v1/user/identity",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleUnlinkIdentity},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+	)
+	return rt
+}
+
+// HandleGetOIDCProviders will return the configured identity providers
+func HandleGetOIDCProviders(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	out := struct {
+		Providers []string `json:"providers"`
+	}{Providers: oidc.Providers()}
+	return sendJSON(w, out)
+}
+
+// HandleStartOIDCLogin will start an identity provider login
+func HandleStartOIDCLogin(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	return startOIDC(env, w, r, 0)
+}
+
+// HandleLinkOIDC will start linking an identity provider to the user
+func HandleLinkOIDC(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	return startOIDC(env, w, r, p.UserID)
+}
+
+func startOIDC(env *env.Env, w http.ResponseWriter, r *http.Request, linkUserID int64) error {
+	in := struct {
+		Provider string `json:"provider"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	authURL, binding, err := domain.StartOIDCLogin(env.DB, in.Provider, linkUserID)
+	if err == oidc.ErrUnknownProvider {
+		return serror.NewBadRequest(err, "domain.StartOIDCLogin", err.Error())
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.StartOIDCLogin")
+	}
+	setOIDCCookie(w, binding, 0)
+	out := struct {
+		AuthURL string `json:"auth_url"`
+	}{AuthURL: authURL}
+	return sendJSON(w, out)
+}
+
+// HandleOIDCCallback will complete an identity provider login
+func HandleOIDCCallback(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Provider string `json:"provider"`
+		State    string `json:"state"`
+		Code     string `json:"code"`
+		DeviceID string `json:"device_id"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
+	}
+	binding := ""
+	if c, err := r.Cookie(oidcCookie); err == nil {
+		binding = c.Value
+	}
+	setOIDCCookie(w, "", -1)
+	user, err := domain.CompleteOIDCLogin(env.DB, p.Provider, p.State, binding, p.Code)
+	switch err {
+	case nil:
+	case oidc.ErrUnknownProvider, domain.ErrInvalidOIDCState:
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	case domain.ErrOIDCNoAccount, domain.ErrIdentityLinked, domain.ErrUserDeleted:
+		return sendJSON1(w, "", false, err.Error(), http.StatusUnauthorized)
+	default:
+		// failed exchanges and id token verification
+		return serror.New(http.StatusUnauthorized, err, "domain.CompleteOIDCLogin", "Identity provider login failed")
+	}
+	return completeLogin(env, w, user, dev)
+}
+
+// setOIDCCookie sets the login binding cookie for the browser session, a
+// negative maxAge removes it. The callback may come from another site so the
+// cookie is SameSite=None, the binding is useless to anyone but the browser
+// holding it
+func setOIDCCookie(w http.ResponseWriter, binding string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    binding,
+		Path:     "/api/v1/oidc",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// HandleGetUserIdentities will return the identities linked to the user
+func HandleGetUserIdentities(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	idents, err := domain.GetUserIdentities(env.DB, p.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserIdentities")
+	}
+	return sendJSON(w, idents)
+}
+
+// HandleUnlinkIdentity will unlink one of the user's identities
+func HandleUnlinkIdentity(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserIdentityID int64 `json:"user_identity_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := domain.UnlinkIdentity(env.DB, p.UserID, in.UserIdentityID); err != nil {
+		return serror.NewServer(err, "domain.UnlinkIdentity")
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// OrganizationRoutes returns the organization routes
+func OrganizationRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:    "Organization",
+		Name:        "Create organization",
+		Description: "Creates a top level organization. org_type is 1 organization, 2 location or 3 department",
+		Method:      "POST",
+		Input:       `{"name": "Radica Clinics", "org_type": 1}`,
+		Output:      `{"organization_id": 1, "parent_id": null, "org_type": 1, "name": "Radica Clinics", "created_on": "", "updated_on": ""}`,
+		Path:        "/api/v1/organization",
+		Handler:     handler.AuthHandler{Env: env, Fn: HandleCreateOrganization},
+		Permissions: []int64{domain.PermManageOrg},
+	},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Create child organization",
+			Description: "Creates an organization under organization_id. A child may not be a higher org_type than its parent",
+			Method:      "POST",
+			Input:       `{"organization_id": 1, "name": "Downtown Clinic", "org_type": 2}`,
+			Output:      `{"organization_id": 2, "parent_id": 1, "org_type": 2, "name": "Downtown Clinic", "created_on": "", "updated_on": ""}`,
+			Path:        "/api/v1/organization/child",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleCreateChildOrganization},
+			Permissions: []int64{domain.PermManageOrg},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "List organizations",
+			Description: "Returns the organizations the user is a member of, or every organization for users who manage organizations",
+			Method:      "GET",
+			Output:      `[{"organization_id": 1, "parent_id": null, "org_type": 1, "name": "Radica Clinics", "created_on": "", "updated_on": ""}]`,
+			Path:        "/api/v1/organizations",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetOrganizations},
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:  "Organization",
+			Name:      "Get organization",
+			Method:    "GET",
+			Input:     `organization_id=1`,
+			Output:    `{"organization_id": 1, "parent_id": null, "org_type": 1, "name": "Radica Clinics", "created_on": "", "updated_on": ""}`,
+			Path:      "/api/v1/organization",
+			Handler:   handler.AuthHandler{Env: env, Fn: HandleGetOrganization},
+			OrgScoped: true,
+		},
+		routetable.Route{
+			Category:  "Organization",
+			Name:      "Child organizations",
+			Method:    "GET",
+			Input:     `organization_id=1`,
+			Output:    `[{"organization_id": 2, "parent_id": 1, "org_type": 2, "name": "Downtown Clinic", "created_on": "", "updated_on": ""}]`,
+			Path:      "/api/v1/organization/children",
+			Handler:   handler.AuthHandler{Env: env, Fn: HandleGetChildOrganizations},
+			OrgScoped: true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Rename organization",
+			Method:      "PUT",
+			Input:       `{"organization_id": 1, "name": "Radica Health"}`,
+			Path:        "/api/v1/organization",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleRenameOrganization},
+			Permissions: []int64{domain.PermManageOrg},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Delete organization",
+			Description: "Deletes an organization and removes its members. Child organizations must be deleted first",
+			Method:      "DELETE",
+			Input:       `{"organization_id": 1}`,
+			Path:        "/api/v1/organization",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleDeleteOrganization},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageOrg},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Organization members",
+			Method:      "GET",
+			Input:       `organization_id=1`,
+			Output:      `[{"organization_id": 1, "user_id": 1, "role": 2}]`,
+			Path:        "/api/v1/organization/users",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetOrganizationUsers},
+			Permissions: []int64{domain.PermManageUsers},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Set organization member",
+			Description: "Adds a user to the organization or changes their role there. You may only grant roles whose permissions you hold in the organization and change members whose role you could grant. Adding a user who is not a member requires the Manage Organization permission from your own roles",
+			Method:      "PUT",
+			Input:       `{"organization_id": 1, "user_id": 2, "role": 1}`,
+			Path:        "/api/v1/organization/user",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleSetOrganizationUser},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Remove organization member",
+			Description: "Removes a user from the organization. You may only remove members whose role you could grant",
+			Method:      "DELETE",
+			Input:       `{"organization_id": 1, "user_id": 2}`,
+			Path:        "/api/v1/organization/user",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleRemoveOrganizationUser},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+			OrgScoped:   true,
+		},
+		routetable.Route{
+			Category:    "Organization",
+			Name:        "Organization disease reports",
+			Description: "Returns the disease reports of the members of the organization and its children",
+			Method:      "GET",
+			Input:       `organization_id=1`,
+			Output:      `[{"id": 1, "disease": "test disease", "symtoms": "test1,test2", "disease_date": "2019-08-22 11:05:05", "dbm": 25, "onscreen_time": 4, "user_id": 2}]`,
+			Path:        "/api/v1/organization/diseases",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetOrganizationDiseases},
+			Permissions: []int64{domain.PermManageUsers},
+			Scopes:      []string{"disease:read"},
+			OrgScoped:   true,
+		},
+	)
+	return rt
+}
+
+// HandleCreateOrganization will create a top level organization
+func HandleCreateOrganization(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	return createOrganization(env, w, r, 0)
+}
+
+// HandleCreateChildOrganization will create an organization under another
+func HandleCreateChildOrganization(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	return createOrganization(env, w, r, p.OrgID)
+}
+
+func createOrganization(env *env.Env, w http.ResponseWriter, r *http.Request, parentID int64) error {
+	in := struct {
+		Name    string `json:"name"`
+		OrgType int64  `json:"org_type"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	org, err := domain.CreateOrganization(env.DB, in.Name, in.OrgType, parentID)
+	if err != nil {
+		return serror.NewBadRequest(err, "domain.CreateOrganization", err.Error())
+	}
+	return sendJSON(w, org)
+}
+
+// HandleGetOrganizations will list the user's organizations
+func HandleGetOrganizations(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	perms, err := domain.GetUserPermissions(env.DB, p.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserPermissions")
+	}
+	var orgs []domain.Organization
+	if domain.HasPermissions(perms, domain.PermManageOrg) {
+		orgs, err = domain.GetOrganizations(env.DB)
+	} else {
+		orgs, err = domain.GetUserOrganizations(env.DB, p.UserID)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.GetOrganizations")
+	}
+	return sendJSON(w, orgs)
+}
+
+// HandleGetOrganization will return an organization
+func HandleGetOrganization(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	org, err := domain.GetOrganization(env.DB, p.OrgID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetOrganization")
+	}
+	return sendJSON(w, org)
+}
+
+// HandleGetChildOrganizations will return the organizations under an organization
+func HandleGetChildOrganizations(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	orgs, err := domain.GetChildOrganizations(env.DB, p.OrgID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetChildOrganizations")
+	}
+	return sendJSON(w, orgs)
+}
+
+// HandleRenameOrganization will rename an organization
+func HandleRenameOrganization(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		Name string `json:"name"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := domain.RenameOrganization(env.DB, p.OrgID, in.Name); err != nil {
+		return serror.NewBadRequest(err, "domain.RenameOrganization", err.Error())
+	}
+	return nil
+}
+
+// HandleDeleteOrganization will delete an organization
+func HandleDeleteOrganization(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	err := domain.DeleteOrganization(env.DB, p.OrgID)
+	if err == domain.ErrOrgHasChildren {
+		return serror.NewBadRequest(err, "domain.DeleteOrganization", err.Error())
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.DeleteOrganization")
+	}
+	return nil
+}
+
+// HandleGetOrganizationUsers will list the members of an organization
+func HandleGetOrganizationUsers(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	users, err := domain.GetOrganizationUsers(env.DB, p.OrgID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetOrganizationUsers")
+	}
+	return sendJSON(w, users)
+}
+
+// HandleSetOrganizationUser will add a member or change their role
+func HandleSetOrganizationUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID int64 `json:"user_id"`
+		Role   int64 `json:"role"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.SetOrganizationUser(env.DB, p.UserID, p.OrgID, in.UserID, in.Role)
+	switch err {
+	case nil:
+	case domain.ErrRoleNotGrantable, domain.ErrNotOrgMember:
+		return serror.New(http.StatusForbidden, err, "domain.SetOrganizationUser", err.Error())
+	case domain.ErrUserDeleted:
+		return serror.NewBadRequest(err, "domain.SetOrganizationUser", err.Error())
+	default:
+		return serror.NewServer(err, "domain.SetOrganizationUser")
+	}
+	return nil
+}
+
+// HandleRemoveOrganizationUser will remove a member from an organization
+func HandleRemoveOrganizationUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID int64 `json:"user_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.RemoveOrganizationUser(env.DB, p.UserID, p.OrgID, in.UserID)
+	switch err {
+	case nil:
+	case domain.ErrRoleNotGrantable:
+		return serror.New(http.StatusForbidden, err, "domain.RemoveOrganizationUser", err.Error())
+	default:
+		return serror.NewServer(err, "domain.RemoveOrganizationUser")
+	}
+	return nil
+}
+
+// HandleGetOrganizationDiseases will return the disease reports of an organization's members
+func HandleGetOrganizationDiseases(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	diseases, err := domain.GetOrgDiseases(env.DB, p.OrgID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetOrgDiseases")
+	}
+	return sendJSON(w, diseases)
+}
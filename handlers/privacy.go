@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// PrivacyRoutes returns the personal data routes
+func PrivacyRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:        "Privacy",
+		Name:            "Export my data",
+		Description:     "Downloads a zip of everything held for the user as export.json with csv files of disease reports, diseases, sessions and logins",
+		Method:          "GET",
+		Output:          `radica-export-1.zip`,
+		Path:            "/api/v1/user/export",
+		Handler:         handler.AuthHandler{Env: env, Fn: HandleExportUserData},
+		Sensitive:       true,
+		Permissions:     []int64{domain.PermManageSelf},
+		AllowUnverified: true,
+	},
+		routetable.Route{
+			Category:        "Privacy",
+			Name:            "Erase user",
+			Description:     "Removes a user's disease reports, diseases, password history, sessions and keys. mode anonymize (default) keeps a scrubbed user row, delete removes it. user_id defaults to the caller, erasing another user requires Manage Users. The caller confirms with their password or a two factor code, failures count towards locking the account",
+			Method:          "POST",
+			Input:           `{"user_id": 1, "mode": "anonymize", "reason": "user request", "password": "abc", "code": "123456"}`,
+			Output:          `{"erasure_id": 1, "user_id": 1, "requested_by": 1, "mode": "anonymize", "reason": "user request", "rows_removed": 12, "created_on": ""}`,
+			Path:            "/api/v1/user/erase",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleEraseUser},
+			Sensitive:       true,
+			Permissions:     []int64{domain.PermManageSelf},
+			AllowUnverified: true,
+		},
+		routetable.Route{
+			Category:    "Privacy",
+			Name:        "Erasure audit trail",
+			Method:      "GET",
+			Output:      `[{"erasure_id": 1, "user_id": 1, "requested_by": 1, "mode": "anonymize", "reason": "user request", "rows_removed": 12, "created_on": ""}]`,
+			Path:        "/api/v1/user/erasures",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetErasures},
+			Permissions: []int64{domain.PermManageUsers},
+		},
+	)
+	return rt
+}
+
+// HandleExportUserData will send the user's data as a zip archive
+func HandleExportUserData(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	exp, err := domain.ExportUserData(env.DB, p.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.ExportUserData")
+	}
+	var b bytes.Buffer
+	if err := exp.WriteArchive(&b); err != nil {
+		return serror.NewServer(err, "UserExport.WriteArchive")
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="radica-export-%d.zip"`, p.UserID))
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// HandleEraseUser will erase a user's personal data
+func HandleEraseUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID   int64  `json:"user_id"`
+		Mode     string `json:"mode"`
+		Reason   string `json:"reason"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if in.UserID == 0 {
+		in.UserID = p.UserID
+	}
+	if in.UserID != p.UserID {
+		perms, err := domain.GetUserPermissions(env.DB, p.UserID)
+		if err != nil {
+			return serror.NewServer(err, "domain.GetUserPermissions")
+		}
+		target, err := domain.GetUserPermissions(env.DB, in.UserID)
+		if err != nil {
+			return serror.NewServer(err, "domain.GetUserPermissions")
+		}
+		// users may not erase someone with permissions they do not hold
+		if !domain.HasPermissions(perms, domain.PermManageUsers) || !domain.HasPermissions(perms, target...) {
+			return serror.New(http.StatusForbidden, fmt.Errorf("UserID %v may not erase user %v", p.UserID, in.UserID), "HandleEraseUser")
+		}
+	}
+	err := domain.Reauthenticate(env.DB, p.UserID, in.Password, in.Code, clientIP(r))
+	if te, ok := err.(domain.LoginThrottledError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(te.RetryAfter.Seconds()+1)))
+		return sendJSON1(w, "", false, te.Error(), http.StatusTooManyRequests)
+	}
+	switch err {
+	case nil:
+	case domain.ErrReauthFailed:
+		return serror.New(http.StatusForbidden, err, "domain.Reauthenticate", err.Error())
+	default:
+		return serror.NewServer(err, "domain.Reauthenticate")
+	}
+	e, err := domain.EraseUser(env.DB, p.UserID, in.UserID, in.Mode, in.Reason)
+	switch err {
+	case nil:
+	case domain.ErrInvalidEraseMode:
+		return serror.NewBadRequest(err, "domain.EraseUser", err.Error())
+	case sql.ErrNoRows:
+		return serror.NewBadRequest(err, "domain.EraseUser", "invalid user_id")
+	default:
+		return serror.NewServer(err, "domain.EraseUser")
+	}
+	return sendJSON(w, e)
+}
+
+// HandleGetErasures will list erasure requests
+func HandleGetErasures(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	erasures, err := domain.GetErasures(env.DB)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetErasures")
+	}
+	return sendJSON(w, erasures)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
+)
+
+// SessionRoutes returns the login session routes
+func SessionRoutes(env *env.Env) routetable.RouteTable {
+	rt := routetable.NewRouteTable()
+	rt.Add(routetable.Route{
+		Category:        "Sessions",
+		Name:            "List sessions",
+		Description:     "Returns the devices the user is logged in on. current is set on the session of the request",
+		Method:          "GET",
+		Output:          `[{"session_id": 1, "user_id": 1, "device_id": "2fc4b5912826ad1", "user_agent": "", "ip": "", "created_on": "", "last_seen_on": "", "expires_on": "", "revoked_on": null, "current": true}]`,
+		Path:            "/api/v1/user/sessions",
+		Handler:         handler.AuthHandler{Env: env, Fn: HandleGetSessions},
+		Permissions:     []int64{domain.PermManageSelf},
+		AllowUnverified: true,
+	},
+		routetable.Route{
+			Category:        "Sessions",
+			Name:            "Revoke session",
+			Description:     "Logs the user out of a session, its tokens are rejected",
+			Method:          "DELETE",
+			Input:           `{"session_id": 1}`,
+			Path:            "/api/v1/user/session",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleRevokeSession},
+			Sensitive:       true,
+			Permissions:     []int64{domain.PermManageSelf},
+			AllowUnverified: true,
+		},
+	)
+	return rt
+}
+
+// HandleGetSessions will return the user's active sessions
+func HandleGetSessions(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	sessions, err := domain.GetUserSessions(env.DB, p.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserSessions")
+	}
+	for i := range sessions {
+		sessions[i].Current = p.SessionID > 0 && sessions[i].SessionID == p.SessionID
+	}
+	return sendJSON(w, sessions)
+}
+
+// HandleRevokeSession will revoke one of the user's sessions
+func HandleRevokeSession(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		SessionID int64 `json:"session_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := domain.RevokeSession(env.DB, p.UserID, in.SessionID); err != nil {
+		return serror.NewServer(err, "domain.RevokeSession")
+	}
+	return sendJSON1(w, "", true, "Session revoked", http.StatusOK)
+}
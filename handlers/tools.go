@@ -6,7 +6,12 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
+	"unicode/utf8"
 
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/logger"
 	"github.com/rajendraventurit/radicaapi/lib/serror"
 )
 
@@ -31,6 +36,7 @@ func sendJSON1(w http.ResponseWriter, i interface{}, success bool, message strin
 	//js, err := json.Marshal(&i)
 
 	resp := serror.NewResponseJSON(success, message, i, code)
+	resp.RequestID = w.Header().Get(logger.RequestIDHeader)
 
 	respobj, err := json.Marshal(&resp)
 	if err != nil {
@@ -51,6 +57,14 @@ func getQueryInt64(r *http.Request, key string) (int64, error) {
 	return in, nil
 }
 
+// getOptQueryInt64 returns 0 if key is not set
+func getOptQueryInt64(r *http.Request, key string) (int64, error) {
+	if r.URL.Query().Get(key) == "" {
+		return 0, nil
+	}
+	return getQueryInt64(r, key)
+}
+
 func getQueryBool(r *http.Request, key string) (bool, error) {
 	val := r.URL.Query().Get(key)
 	bl, err := strconv.ParseBool(val)
@@ -59,3 +73,32 @@ func getQueryBool(r *http.Request, key string) (bool, error) {
 	}
 	return bl, nil
 }
+
+// getQueryTime returns an RFC 3339 or YYYY-MM-DD time, nil if key is not set
+func getQueryTime(r *http.Request, key string) (*time.Time, error) {
+	val := r.URL.Query().Get(key)
+	if val == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, val); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, serror.New(http.StatusBadRequest, fmt.Errorf("invalid time %q", val), "time.Parse", fmt.Sprintf("%s is an invalid %s", val, key))
+}
+
+// clientIP returns the ip address of the client
+func clientIP(r *http.Request) string {
+	return handler.ClientIP(r)
+}
+
+// loginDevice returns the device a login request came from. A device_id
+// longer than domain.MaxDeviceID characters is refused
+func loginDevice(r *http.Request, deviceID string) (domain.Device, error) {
+	if utf8.RuneCountInString(deviceID) > domain.MaxDeviceID {
+		err := fmt.Errorf("device_id may not be longer than %d characters", domain.MaxDeviceID)
+		return domain.Device{}, serror.NewBadRequest(err, "loginDevice", err.Error())
+	}
+	return domain.Device{ID: deviceID, UserAgent: r.UserAgent(), IP: clientIP(r)}, nil
+}
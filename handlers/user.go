@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/rajendraventurit/radicaapi/domain"
 	"github.com/rajendraventurit/radicaapi/lib/env"
 	"github.com/rajendraventurit/radicaapi/lib/handler"
+	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/ratelimit"
 	"github.com/rajendraventurit/radicaapi/lib/routetable"
 	"github.com/rajendraventurit/radicaapi/lib/serror"
 	"github.com/rajendraventurit/radicaapi/lib/token"
@@ -17,33 +18,117 @@ import (
 func UserRoutes(env *env.Env) routetable.RouteTable {
 	rt := routetable.NewRouteTable()
 	rt.Add(routetable.Route{
-		Category: "User",
-		Name:     "User login",
-		Method:   "POST",
-		Input:    `{"email": "name", "password": "abc"}`,
-		Output:   `{"user_id": 0, "first_name": "", "last_name": "", "email": "", "created_on": "", "updated_on": "", "deleted": false, "token": "abc", "roles": [1]}`,
-		Path:     "/api/v1/user/login",
-		Handler:  handler.Handler{Env: env, Fn: HandleLogin},
-		Insecure: true,
+		Category:    "User",
+		Name:        "User login",
+		Description: "Users with two factor authentication enabled receive mfa_required and an mfa_token for the two factor login instead of a token. Users whose password has expired receive password_expired and a password_token",
+		Method:      "POST",
+		Input:       `{"email": "name", "password": "abc", "device_id": "2fc4b5912826ad1"}`,
+		Output:      `{"user_id": 0, "first_name": "", "last_name": "", "email": "", "created_on": "", "updated_on": "", "deleted": false, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+		Path:        "/api/v1/user/login",
+		Handler:     handler.Handler{Env: env, Fn: HandleLogin},
+		RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 60, Burst: 5},
+		Insecure:    true,
 	},
 		routetable.Route{
-			Category: "User",
-			Name:     "Create user",
-			Method:   "POST",
-			Input:    `{"first_name": "", "last_name": "", "email": "", "password": ""}`,
-			Path:     "/api/v1/user",
-			Handler:  handler.Handler{Env: env, Fn: HandleCreateUser},
-			Insecure: true,
+			Category:    "User",
+			Name:        "Refresh token",
+			Description: "Exchanges a refresh token for a new token and refresh token. A refresh token may only be used once",
+			Method:      "POST",
+			Input:       `{"refresh_token": "abc", "device_id": "2fc4b5912826ad1"}`,
+			Output:      `{"user_id": 0, "token": "abc", "refresh_token": "abc", "expires_in": 900}`,
+			Path:        "/api/v1/user/token/refresh",
+			Handler:     handler.Handler{Env: env, Fn: HandleRefreshToken},
+			RateLimit:   &ratelimit.Limit{Requests: 30, Seconds: 60},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Request login link",
+			Description: "Emails a single use sign in link. The response is the same whether or not the email belongs to a user. Requests from an ip are limited",
+			Method:      "POST",
+			Input:       `{"email": ""}`,
+			Path:        "/api/v1/user/login/link",
+			Handler:     handler.Handler{Env: env, Fn: HandleRequestLoginLink},
+			RateLimit:   &ratelimit.Limit{Requests: 5, Seconds: 300},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Login with link",
+			Description: "Exchanges the token from a login link for the same response as User login",
+			Method:      "POST",
+			Input:       `{"token": "abc", "device_id": "2fc4b5912826ad1"}`,
+			Output:      `{"user_id": 0, "first_name": "", "last_name": "", "email": "", "created_on": "", "updated_on": "", "deleted": false, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+			Path:        "/api/v1/user/login/link/redeem",
+			Handler:     handler.Handler{Env: env, Fn: HandleLoginLink},
+			RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 60},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:        "User",
+			Name:            "Logout",
+			Description:     "Revokes the token and the refresh token issued with it",
+			Method:          "POST",
+			Input:           `{"refresh_token": "abc"}`,
+			Path:            "/api/v1/user/logout",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleLogout},
+			Sensitive:       true,
+			AllowUnverified: true,
+		},
+		routetable.Route{
+			Category:        "User",
+			Name:            "Logout everywhere",
+			Description:     "Revokes every token and refresh token issued to the user and every api key acting as them",
+			Method:          "POST",
+			Path:            "/api/v1/user/logout/all",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleLogoutAll},
+			Sensitive:       true,
+			AllowUnverified: true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Create user",
+			Description: "New users are unverified until they follow the link in the verification email",
+			Method:      "POST",
+			Input:       `{"first_name": "", "last_name": "", "email": "", "password": ""}`,
+			Path:        "/api/v1/user",
+			Handler:     handler.Handler{Env: env, Fn: HandleCreateUser},
+			RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 3600},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Verify email",
+			Description: "Verifies the email of the user in a verification link",
+			Method:      "POST",
+			Input:       `{"token": "abc"}`,
+			Path:        "/api/v1/user/verify",
+			Handler:     handler.Handler{Env: env, Fn: HandleVerifyEmail},
+			Sensitive:   true,
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Resend verification",
+			Description: "Sends a new verification link. The response is the same whether or not the email belongs to an unverified user",
+			Method:      "POST",
+			Input:       `{"email": ""}`,
+			Path:        "/api/v1/user/verify/resend",
+			Handler:     handler.Handler{Env: env, Fn: HandleResendVerification},
+			Sensitive:   true,
+			RateLimit:   &ratelimit.Limit{Requests: 5, Seconds: 300},
+			Insecure:    true,
 		},
 
 		routetable.Route{
-			Category: "User",
-			Name:     "Users Activity",
-			Method:   "POST",
-			Input:    `{"device_id": "2fc4b5912826ad1", "activity_type": "open_app/dashboard/setting"}`,
-			Path:     "/api/v1/user/activity",
-			Handler:  handler.Handler{Env: env, Fn: HandleUserActivity},
-			Insecure: true,
+			Category:  "User",
+			Name:      "Users Activity",
+			Method:    "POST",
+			Input:     `{"device_id": "2fc4b5912826ad1", "activity_type": "open_app/dashboard/setting"}`,
+			Path:      "/api/v1/user/activity",
+			Handler:   handler.Handler{Env: env, Fn: HandleUserActivity},
+			RateLimit: &ratelimit.Limit{Requests: 60, Seconds: 60},
+			Insecure:  true,
 		},
 
 		routetable.Route{
@@ -52,7 +137,8 @@ func UserRoutes(env *env.Env) routetable.RouteTable {
 			Method:   "POST",
 			Input:    `{ "disease": "test disease","symtoms": "test1,test2,test3","disease_date":"2019-08-22 11:05:05","dbm":25,"onscreen_time":4}`,
 			Path:     "/api/v1/user/createdisease",
-			Handler:  handler.Handler{Env: env, Fn: HandleCreateDisease},
+			Handler:  handler.AuthHandler{Env: env, Fn: HandleCreateDisease},
+			Scopes:   []string{"disease:write"},
 		},
 
 		routetable.Route{
@@ -61,7 +147,8 @@ func UserRoutes(env *env.Env) routetable.RouteTable {
 			Method:   "GET",
 			Input:    `{}`,
 			Path:     "/api/v1/user/disease",
-			Handler:  handler.Handler{Env: env, Fn: HandleGetDisease},
+			Handler:  handler.AuthHandler{Env: env, Fn: HandleGetDisease},
+			Scopes:   []string{"disease:read"},
 		},
 
 		routetable.Route{
@@ -70,7 +157,8 @@ func UserRoutes(env *env.Env) routetable.RouteTable {
 			Method:   "POST",
 			Input:    `{}`,
 			Path:     "/api/v1/disease/add",
-			Handler:  handler.Handler{Env: env, Fn: HandleAddDisease},
+			Handler:  handler.AuthHandler{Env: env, Fn: HandleAddDisease},
+			Scopes:   []string{"disease:write"},
 		},
 
 		routetable.Route{
@@ -79,52 +167,117 @@ func UserRoutes(env *env.Env) routetable.RouteTable {
 			Method:   "GET",
 			Input:    `{}`,
 			Path:     "/api/v1/stats",
-			Handler:  handler.Handler{Env: env, Fn: HandleGetStats},
+			Handler:  handler.AuthHandler{Env: env, Fn: HandleGetStats},
+			Scopes:   []string{"stats:read"},
 		},
 
-		// routetable.Route{
-		// 	Category:    "User",
-		// 	Name:        "Delete user",
-		// 	Method:      "DELETE",
-		// 	Input:       `{"user_id": 345}`,
-		// 	Path:        "/api/v1/user",
-		// 	Handler:     handler.Handler{Env: env, Fn: HandleDeleteUser},
-		// 	Permissions: []int64{domain.PermManageUsers},
-		// },
-		// routetable.Route{
-		// 	Category:    "User",
-		// 	Name:        "Change Password",
-		// 	Method:      "PUT",
-		// 	Input:       `{"password": ""}`,
-		// 	Path:        "/api/v1/user/password",
-		// 	Handler:     handler.Handler{Env: env, Fn: HandleChangePassword},
-		// 	Permissions: []int64{domain.PermManageSelf},
-		// },
-		// routetable.Route{
-		// 	Category: "User",
-		// 	Name:     "Request reset password",
-		// 	Method:   "POST",
-		// 	Input:    `{"email": "", "reset_url": ""}`,
-		// 	Path:     "/api/v1/user/password/reset",
-		// 	Handler:  handler.Handler{Env: env, Fn: HandleRequestResetPassword},
-		// 	Insecure: true,
-		// },
-		// routetable.Route{
-		// 	Category: "User",
-		// 	Name:     "Validate and reset password",
-		// 	Method:   "PUT",
-		// 	Input:    `{"email": "", "password": "", "token": ""}`,
-		// 	Path:     "/api/v1/user/password/reset",
-		// 	Handler:  handler.Handler{Env: env, Fn: HandleResetPassword},
-		// 	Insecure: true,
-		// },
 		routetable.Route{
-			Category: "User",
-			Name:     "Get User",
-			Method:   "GET",
-			Input:    `?user_id=1`,
-			Path:     "/api/v1/user",
-			Handler:  handler.Handler{Env: env, Fn: HandleGetUser},
+			Category:    "User",
+			Name:        "Delete user",
+			Method:      "DELETE",
+			Input:       `{"user_id": 345}`,
+			Path:        "/api/v1/user",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleDeleteUser},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Change Password",
+			Method:      "PUT",
+			Input:       `{"password": ""}`,
+			Path:        "/api/v1/user/password",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleChangePassword},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageSelf},
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Locked accounts",
+			Description: "Lists accounts locked after too many failed logins",
+			Method:      "GET",
+			Output:      `[{"account_lock_id": 1, "user_id": 345, "reason": "", "locked_on": "", "locked_until": "", "unlocked_on": null, "unlocked_by": null}]`,
+			Path:        "/api/v1/user/locks",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleGetAccountLocks},
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Unlock account",
+			Method:      "POST",
+			Input:       `{"user_id": 345}`,
+			Path:        "/api/v1/user/unlock",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleUnlockAccount},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Set user roles",
+			Description: "Replaces a user's roles. Only roles whose permissions the caller holds may be granted",
+			Method:      "PUT",
+			Input:       `{"user_id": 345, "roles": [1, 2]}`,
+			Path:        "/api/v1/user/roles",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleSetUserRoles},
+			Sensitive:   true,
+			Permissions: []int64{domain.PermManageUsers},
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Change expired password",
+			Description: "Users whose password has expired receive password_expired and a password_token from login instead of a token. The new password must meet the password policy",
+			Method:      "POST",
+			Input:       `{"password_token": "abc", "password": "", "device_id": "2fc4b5912826ad1"}`,
+			Output:      `{"user_id": 0, "token": "abc", "refresh_token": "abc", "expires_in": 900, "roles": [1]}`,
+			Path:        "/api/v1/user/password/expired",
+			Handler:     handler.Handler{Env: env, Fn: HandleExpiredPassword},
+			RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 60},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Request reset password",
+			Description: "Emails a single use reset link. The response is the same whether or not the email belongs to a user",
+			Method:      "POST",
+			Input:       `{"email": ""}`,
+			Path:        "/api/v1/user/password/reset",
+			Handler:     handler.Handler{Env: env, Fn: HandleRequestResetPassword},
+			RateLimit:   &ratelimit.Limit{Requests: 5, Seconds: 300},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "Validate and reset password",
+			Description: "Resets the password with the token from the reset link and logs the user out everywhere",
+			Method:      "PUT",
+			Input:       `{"password": "", "token": ""}`,
+			Path:        "/api/v1/user/password/reset",
+			Handler:     handler.Handler{Env: env, Fn: HandleResetPassword},
+			RateLimit:   &ratelimit.Limit{Requests: 10, Seconds: 60},
+			Insecure:    true,
+		},
+		routetable.Route{
+			Category:        "User",
+			Name:            "Get User",
+			Description:     "user_id defaults to the caller, reading another user requires Manage Users",
+			Method:          "GET",
+			Input:           `?user_id=1`,
+			Path:            "/api/v1/user",
+			Handler:         handler.AuthHandler{Env: env, Fn: HandleGetUser},
+			Scopes:          []string{"user:read"},
+			AllowUnverified: true,
+		},
+		routetable.Route{
+			Category:    "User",
+			Name:        "List users",
+			Description: "Pages through users with offset or the next_cursor of the previous page. search matches name and email. status is active, invited or deleted, deleted users are excluded by default. created_after and created_before are RFC 3339 or YYYY-MM-DD. sort is one of user_id, email, first_name, last_name, created_on, prefix with - to sort descending. limit defaults to 50, at most 200",
+			Method:      "GET",
+			Input:       `?search=doe&status=active&role_id=1&disease_id=2&created_after=2019-01-01&created_before=2020-01-01&sort=-created_on&offset=0&limit=50&cursor=`,
+			Output:      `{"users": [{"user_id": 1, "first_name": "John", "last_name": "Doe", "email": "jdoe@somewhere.com", "status": "Active", "roles": [1]}], "total": 1, "offset": 0, "limit": 50, "next_cursor": "abc"}`,
+			Path:        "/api/v1/users",
+			Handler:     handler.AuthHandler{Env: env, Fn: HandleListUsers},
+			Permissions: []int64{domain.PermManageUsers},
+			Scopes:      []string{"user:read"},
 		},
 	)
 	return rt
@@ -135,18 +288,165 @@ func HandleLogin(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		DeviceID string `json:"device_id"`
 	}{}
 	if err := decodeJSON(r.Body, &p); err != nil {
 		return err
 	}
-	user, err := domain.Authenticate(env.DB, p.Email, p.Password)
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
+	}
+	user, err := domain.Login(env.DB, p.Email, p.Password, clientIP(r))
+	if te, ok := err.(domain.LoginThrottledError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(te.RetryAfter.Seconds()+1)))
+		return sendJSON1(w, "", false, te.Error(), http.StatusTooManyRequests)
+	}
 	if err != nil {
 		return sendJSON1(w, "", false, "Username and password did not match", http.StatusUnauthorized)
 	}
+	return completeLogin(env, w, user, dev)
+}
+
+// HandleRequestLoginLink will email a sign in link to a user
+func HandleRequestLoginLink(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Email string `json:"email"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.SendLoginLink(env.DB, p.Email, clientIP(r))
+	if te, ok := err.(domain.LoginThrottledError); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(te.RetryAfter.Seconds()+1)))
+		return sendJSON1(w, "", false, "Too many login link requests", http.StatusTooManyRequests)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.SendLoginLink")
+	}
+	return sendJSON1(w, "", true, "If the email belongs to a user a login link has been sent", http.StatusOK)
+}
+
+// HandleLoginLink will login a user with the token from a login link
+func HandleLoginLink(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Token    string `json:"token"`
+		DeviceID string `json:"device_id"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
+	}
+	user, err := domain.RedeemLoginLink(env.DB, p.Token)
+	if err == domain.ErrInvalidLoginLink || err == domain.ErrUserDeleted {
+		return sendJSON1(w, "", false, err.Error(), http.StatusUnauthorized)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.RedeemLoginLink")
+	}
+	return completeLogin(env, w, user, dev)
+}
+
+// completeLogin finishes a login for an authenticated user. If the user has
+// two factor authentication enabled a challenge is returned instead of tokens
+func completeLogin(env *env.Env, w http.ResponseWriter, user *domain.User, dev domain.Device) error {
+	if !user.Verified() && domain.UnverifiedPolicy() == domain.VerifyPolicyDeny {
+		return sendJSON1(w, "", false, domain.ErrEmailNotVerified.Error(), http.StatusForbidden)
+	}
+	mfa, err := domain.MFAEnabled(env.DB, user.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.MFAEnabled")
+	}
+	if mfa {
+		tok, err := token.NewChallenge(user.UserID, token.PurposeMFA)
+		if err != nil {
+			return serror.NewServer(err, "token.NewChallenge")
+		}
+		challenge := struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}{MFARequired: true, MFAToken: tok}
+		return sendJSON1(w, challenge, true, "Two factor code required", http.StatusOK)
+	}
+	return finishLogin(env, w, user, dev)
+}
+
+// finishLogin issues tokens to a user who has passed every login factor. If
+// the password has expired a password_token to change it is returned instead
+func finishLogin(env *env.Env, w http.ResponseWriter, user *domain.User, dev domain.Device) error {
+	if user.PasswordExpired() {
+		tok, err := token.NewChallenge(user.UserID, token.PurposePassword)
+		if err != nil {
+			return serror.NewServer(err, "token.NewChallenge")
+		}
+		challenge := struct {
+			PasswordExpired bool   `json:"password_expired"`
+			PasswordToken   string `json:"password_token"`
+		}{PasswordExpired: true, PasswordToken: tok}
+		return sendJSON1(w, challenge, true, "Password has expired", http.StatusOK)
+	}
+	if err := domain.IssueTokens(env.DB, user, dev); err != nil {
+		return serror.NewServer(err, "domain.IssueTokens")
+	}
 	//return sendJSON(w, user)
 	return sendJSON1(w, user, true, "Loggedin Successfully", http.StatusOK)
 }
 
+// HandleRefreshToken will rotate a refresh token
+func HandleRefreshToken(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		RefreshToken string `json:"refresh_token"`
+		DeviceID     string `json:"device_id"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	user, err := domain.RotateRefreshToken(env.DB, p.RefreshToken, p.DeviceID)
+	switch err {
+	case nil:
+	case domain.ErrInvalidRefreshToken, domain.ErrRefreshTokenReused, domain.ErrUserDeleted:
+		return sendJSON1(w, "", false, err.Error(), http.StatusUnauthorized)
+	default:
+		return serror.NewServer(err, "domain.RotateRefreshToken")
+	}
+	return sendJSON1(w, user, true, "Token refreshed", http.StatusOK)
+}
+
+// HandleLogout will revoke the caller's token
+func HandleLogout(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	if p.Claims == nil {
+		return serror.NewBadRequest(fmt.Errorf("not a token"), "HandleLogout", "API keys can not be logged out")
+	}
+	in := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &in); err != nil {
+			return err
+		}
+		defer r.Body.Close()
+	}
+	if err := domain.Logout(env.DB, p.Claims, in.RefreshToken); err != nil {
+		return serror.NewServer(err, "domain.Logout")
+	}
+	return sendJSON1(w, "", true, "Logged out", http.StatusOK)
+}
+
+// HandleLogoutAll will revoke all of the caller's tokens and api keys
+func HandleLogoutAll(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	if err := domain.RevokeAllTokens(env.DB, p.UserID); err != nil {
+		return serror.NewServer(err, "domain.RevokeAllTokens")
+	}
+	return sendJSON1(w, "", true, "Logged out everywhere", http.StatusOK)
+}
+
 // HandleCreateUser will create a new org and user
 func HandleCreateUser(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
@@ -166,6 +466,9 @@ func HandleCreateUser(env *env.Env, w http.ResponseWriter, r *http.Request) erro
 
 	// Create user
 	usr, err := domain.CreateUser(env.DB, p.FirstName, p.LastName, p.Email, p.Password)
+	if perr, ok := err.(domain.PasswordError); ok {
+		return sendJSON1(w, perr, false, perr.Error(), http.StatusBadRequest)
+	}
 	if err != nil {
 		return serror.Error{
 			Code:    http.StatusBadRequest,
@@ -175,9 +478,47 @@ func HandleCreateUser(env *env.Env, w http.ResponseWriter, r *http.Request) erro
 		}
 	}
 	usr.Password = ""
+	if err := domain.SendVerification(usr); err != nil {
+		// the user can request another link
+		logger.ErrorfContext(r.Context(), "domain.SendVerification user %v %v", usr.UserID, err)
+	}
 	return sendJSON(w, usr)
 }
 
+// HandleVerifyEmail will verify a user's email
+func HandleVerifyEmail(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Token string `json:"token"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	_, err := domain.VerifyEmail(env.DB, p.Token)
+	if err == domain.ErrInvalidVerifyToken {
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.VerifyEmail")
+	}
+	return sendJSON1(w, "", true, "Email verified", http.StatusOK)
+}
+
+// HandleResendVerification will send a new verification link
+func HandleResendVerification(env *env.Env, w http.ResponseWriter, r *http.Request) error {
+	p := struct {
+		Email string `json:"email"`
+	}{}
+	if err := decodeJSON(r.Body, &p); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := domain.ResendVerification(env.DB, p.Email); err != nil {
+		return serror.NewServer(err, "domain.ResendVerification")
+	}
+	return sendJSON1(w, "", true, "If the email belongs to an unverified account a verification link has been sent", http.StatusOK)
+}
+
 // HandleUserActivity will track users activity
 func HandleUserActivity(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
@@ -210,17 +551,8 @@ func HandleUserActivity(env *env.Env, w http.ResponseWriter, r *http.Request) er
 }
 
 // HandleCreateDisease will create Disease of user
-func HandleCreateDisease(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-
-	claims, err := token.AuthToken(r)
-
-	fmt.Println("err", err)
-
-	if err != nil {
-		return serror.New(http.StatusUnauthorized, err, "token.AuthToken", "")
-	}
-
-	p := struct {
+func HandleCreateDisease(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
 		Disease      string `json:"disease"`
 		Symtoms      string `json:"symtoms"`
 		DiseaseDate  string `json:"disease_date"`
@@ -228,13 +560,13 @@ func HandleCreateDisease(env *env.Env, w http.ResponseWriter, r *http.Request) e
 		OnscreenTime int64  `json:"onscreen_time"`
 	}{}
 
-	if err := decodeJSON(r.Body, &p); err != nil {
+	if err := decodeJSON(r.Body, &in); err != nil {
 		return err
 	}
 	defer r.Body.Close()
 
 	// Create axctivity
-	err = domain.CreateDisease(env.DB, p.Disease, p.Symtoms, p.DiseaseDate, p.Dbm, p.OnscreenTime, claims.UserID)
+	err := domain.CreateDisease(env.DB, in.Disease, in.Symtoms, in.DiseaseDate, in.Dbm, in.OnscreenTime, p.UserID)
 	if err != nil {
 		return serror.Error{
 			Code:    http.StatusBadRequest,
@@ -249,24 +581,17 @@ func HandleCreateDisease(env *env.Env, w http.ResponseWriter, r *http.Request) e
 }
 
 // HandleAddDisease will add Disease of user
-func HandleAddDisease(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-
-	claims, err := token.AuthToken(r)
-
-	if err != nil {
-		return serror.New(http.StatusUnauthorized, err, "token.AuthToken", "")
-	}
-
-	p := struct {
+func HandleAddDisease(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
 		DiseaseID int64 `json:"disease_id"`
 	}{}
 
-	if err := decodeJSON(r.Body, &p); err != nil {
+	if err := decodeJSON(r.Body, &in); err != nil {
 		return err
 	}
 	defer r.Body.Close()
 
-	err = domain.CheckIfAlreadyExist(env.DB, p.DiseaseID, claims.UserID)
+	err := domain.CheckIfAlreadyExist(env.DB, in.DiseaseID, p.UserID)
 
 	if err != nil {
 		return serror.Error{
@@ -278,7 +603,7 @@ func HandleAddDisease(env *env.Env, w http.ResponseWriter, r *http.Request) erro
 	}
 
 	// Create axctivity
-	err = domain.AddDisease(env.DB, p.DiseaseID, claims.UserID)
+	err = domain.AddDisease(env.DB, in.DiseaseID, p.UserID)
 	if err != nil {
 		return serror.Error{
 			Code:    http.StatusBadRequest,
@@ -293,14 +618,11 @@ func HandleAddDisease(env *env.Env, w http.ResponseWriter, r *http.Request) erro
 }
 
 // HandleGetStats will get all the stats
-func HandleGetStats(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-
-	claims, err := token.AuthToken(r)
-
+func HandleGetStats(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
 
 	// get disease of user
-	dis, err := domain.GetUserStats(env.DB, claims.UserID)
+	dis, err := domain.GetUserStats(env.DB, p.UserID)
 	if err != nil {
 		return serror.Error{
 			Code:    http.StatusBadRequest,
@@ -315,14 +637,11 @@ func HandleGetStats(env *env.Env, w http.ResponseWriter, r *http.Request) error
 }
 
 // HandleGetDisease will get all the disease
-func HandleGetDisease(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-
-	claims, err := token.AuthToken(r)
-
+func HandleGetDisease(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
 	defer r.Body.Close()
 
 	// get disease of user
-	dis, err := domain.GetUserDisease(env.DB, claims.UserID)
+	dis, err := domain.GetUserDisease(env.DB, p.UserID)
 	if err != nil {
 		return serror.Error{
 			Code:    http.StatusBadRequest,
@@ -337,62 +656,172 @@ func HandleGetDisease(env *env.Env, w http.ResponseWriter, r *http.Request) erro
 }
 
 // HandleDeleteUser will delete a users
-func HandleDeleteUser(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-	p := struct {
+func HandleDeleteUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
 		UserID int64 `json:"user_id"`
 	}{}
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	if err := decodeJSON(r.Body, &in); err != nil {
 		return err
 	}
 	defer r.Body.Close()
-	if p.UserID == 0 {
+	if in.UserID == 0 {
 		return serror.NewBadRequest(fmt.Errorf("Invalid user_id"), "HandleDeleteUser", "invalid user_id")
 	}
-	if err := domain.MarkUserDeleted(env.DB, p.UserID); err != nil {
+	// users may not delete someone with permissions they do not hold
+	err := domain.CheckManageable(env.DB, p.UserID, in.UserID)
+	switch err {
+	case nil:
+	case domain.ErrUserNotManageable:
+		return serror.New(http.StatusForbidden, err, "domain.CheckManageable", err.Error())
+	default:
+		return serror.NewServer(err, "domain.CheckManageable")
+	}
+	if err := domain.MarkUserDeleted(env.DB, in.UserID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// HandleGetAccountLocks will list locked accounts
+func HandleGetAccountLocks(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	locks, err := domain.GetAccountLocks(env.DB)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetAccountLocks")
+	}
+	return sendJSON(w, locks)
+}
+
+// HandleUnlockAccount will unlock an account locked by failed logins
+func HandleUnlockAccount(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID int64 `json:"user_id"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if in.UserID == 0 {
+		return serror.NewBadRequest(fmt.Errorf("Invalid user_id"), "HandleUnlockAccount", "invalid user_id")
+	}
+	if err := domain.UnlockAccount(env.DB, in.UserID, p.UserID); err != nil {
+		return serror.NewServer(err, "domain.UnlockAccount")
+	}
+	return nil
+}
+
+// HandleSetUserRoles will replace a users roles
+func HandleSetUserRoles(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		UserID int64   `json:"user_id"`
+		Roles  []int64 `json:"roles"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
 		return err
 	}
+	defer r.Body.Close()
+	if in.UserID == 0 {
+		return serror.NewBadRequest(fmt.Errorf("Invalid user_id"), "HandleSetUserRoles", "invalid user_id")
+	}
+	err := domain.SetUserRoles(env.DB, p.UserID, in.UserID, in.Roles...)
+	switch err {
+	case nil:
+	case domain.ErrRoleNotGrantable, domain.ErrUserNotManageable:
+		return serror.New(http.StatusForbidden, err, "domain.SetUserRoles", err.Error())
+	case domain.ErrInvalidRole:
+		return serror.NewBadRequest(err, "domain.SetUserRoles", err.Error())
+	default:
+		return serror.NewServer(err, "domain.SetUserRoles")
+	}
 	return nil
 }
 
 // HandleChangePassword will change a users password
-func HandleChangePassword(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-	claims, err := token.AuthToken(r)
+func HandleChangePassword(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	in := struct {
+		Password string `json:"password"`
+	}{}
+	if err := decodeJSON(r.Body, &in); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	err := domain.UpdatePassword(env.DB, p.UserID, in.Password)
+	if perr, ok := err.(domain.PasswordError); ok {
+		return sendJSON1(w, perr, false, perr.Error(), http.StatusBadRequest)
+	}
 	if err != nil {
-		return serror.New(http.StatusUnauthorized, err, "token.AuthToken", "")
+		return serror.NewServer(err, "domain.UpdatePassword")
 	}
+	return nil
+}
+
+// HandleExpiredPassword will change an expired password with the
+// password_token from login and complete the login
+func HandleExpiredPassword(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
-		Password string `json:"password"`
+		PasswordToken string `json:"password_token"`
+		Password      string `json:"password"`
+		DeviceID      string `json:"device_id"`
 	}{}
 	if err := decodeJSON(r.Body, &p); err != nil {
 		return err
 	}
 	defer r.Body.Close()
-	if err := domain.UpdatePassword(env.DB, claims.UserID, p.Password); err != nil {
-		return serror.NewBadRequest(err, "domain.UpdatePassword", err.Error())
+	dev, err := loginDevice(r, p.DeviceID)
+	if err != nil {
+		return err
 	}
-	return nil
+
+	claims, err := token.DecodeChallenge(p.PasswordToken, token.PurposePassword)
+	if err != nil {
+		return sendJSON1(w, "", false, "Invalid or expired password_token", http.StatusUnauthorized)
+	}
+	revoked, err := token.IsRevoked(env.DB, claims)
+	if err != nil {
+		return serror.NewServer(err, "token.IsRevoked")
+	}
+	if revoked {
+		return sendJSON1(w, "", false, "Invalid or expired password_token", http.StatusUnauthorized)
+	}
+	err = domain.UpdatePassword(env.DB, claims.UserID, p.Password)
+	if perr, ok := err.(domain.PasswordError); ok {
+		return sendJSON1(w, perr, false, perr.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.UpdatePassword")
+	}
+	// the challenge is single use
+	if err := token.Revoke(env.DB, claims); err != nil {
+		return serror.NewServer(err, "token.Revoke")
+	}
+
+	user, err := domain.GetUserWithID(env.DB, claims.UserID)
+	if err != nil {
+		return serror.NewServer(err, "domain.GetUserWithID")
+	}
+	if user.Deleted {
+		return sendJSON1(w, "", false, domain.ErrUserDeleted.Error(), http.StatusUnauthorized)
+	}
+	return finishLogin(env, w, user, dev)
 }
 
 // HandleRequestResetPassword will send a reset password link to a user
 func HandleRequestResetPassword(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
-		Email    string `json:"email"`
-		ResetURL string `json:"reset_url"`
+		Email string `json:"email"`
 	}{}
 	if err := decodeJSON(r.Body, &p); err != nil {
 		return err
 	}
 	defer r.Body.Close()
-	if err := domain.SendResetToken(env.DB, p.Email, p.ResetURL); err != nil {
-		return serror.NewBadRequest(err, "domain.SendResetToekn", "Failed to send reset")
+	if err := domain.SendResetToken(env.DB, p.Email); err != nil {
+		return serror.NewServer(err, "domain.SendResetToken")
 	}
-	return nil
+	return sendJSON1(w, "", true, "If the email belongs to a user a reset link has been sent", http.StatusOK)
 }
 
 // HandleResetPassword will validate a reset token and change password
 func HandleResetPassword(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	p := struct {
-		Email    string `json:"email"`
 		Password string `json:"password"`
 		Token    string `json:"token"`
 	}{}
@@ -400,18 +829,37 @@ func HandleResetPassword(env *env.Env, w http.ResponseWriter, r *http.Request) e
 		return err
 	}
 	defer r.Body.Close()
-	if err := domain.ResetPassword(env.DB, p.Email, p.Token, p.Password); err != nil {
-		return serror.NewBadRequest(err, "domain.ResetPassword", err.Error())
+	err := domain.ResetPassword(env.DB, p.Token, p.Password)
+	if perr, ok := err.(domain.PasswordError); ok {
+		return sendJSON1(w, perr, false, perr.Error(), http.StatusBadRequest)
 	}
-	return nil
+	if err == domain.ErrInvalidResetToken {
+		return sendJSON1(w, "", false, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return serror.NewServer(err, "domain.ResetPassword")
+	}
+	return sendJSON1(w, "", true, "Password has been reset", http.StatusOK)
 }
 
 // HandleGetUser will return a user
-func HandleGetUser(env *env.Env, w http.ResponseWriter, r *http.Request) error {
-	uid, err := getQueryInt64(r, "user_id")
+func HandleGetUser(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	uid, err := getOptQueryInt64(r, "user_id")
 	if err != nil {
 		return err
 	}
+	if uid == 0 {
+		uid = p.UserID
+	}
+	if uid != p.UserID {
+		perms, err := domain.GetUserPermissions(env.DB, p.UserID)
+		if err != nil {
+			return serror.NewServer(err, "domain.GetUserPermissions")
+		}
+		if !domain.HasPermissions(perms, domain.PermManageUsers) {
+			return serror.New(http.StatusForbidden, fmt.Errorf("UserID %v may not read user %v", p.UserID, uid), "HandleGetUser")
+		}
+	}
 	user, err := domain.GetUser(env.DB, uid)
 	if err != nil {
 		return serror.NewBadRequest(err, "domain.GetUser")
@@ -419,3 +867,48 @@ func HandleGetUser(env *env.Env, w http.ResponseWriter, r *http.Request) error {
 	user.Password = ""
 	return sendJSON(w, user)
 }
+
+// HandleListUsers will return a page of users
+func HandleListUsers(env *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	f := domain.UserFilter{
+		Search: q.Get("search"),
+		Sort:   q.Get("sort"),
+		Cursor: q.Get("cursor"),
+	}
+	var err error
+	if f.RoleID, err = getOptQueryInt64(r, "role_id"); err != nil {
+		return err
+	}
+	if f.DiseaseID, err = getOptQueryInt64(r, "disease_id"); err != nil {
+		return err
+	}
+	if f.Offset, err = getOptQueryInt64(r, "offset"); err != nil {
+		return err
+	}
+	if f.Limit, err = getOptQueryInt64(r, "limit"); err != nil {
+		return err
+	}
+	if s := q.Get("status"); s != "" {
+		status, err := domain.ParseUserStatus(s)
+		if err != nil {
+			return serror.NewBadRequest(err, "domain.ParseUserStatus", err.Error())
+		}
+		f.Status = &status
+	}
+	if f.CreatedAfter, err = getQueryTime(r, "created_after"); err != nil {
+		return err
+	}
+	if f.CreatedBefore, err = getQueryTime(r, "created_before"); err != nil {
+		return err
+	}
+	list, err := domain.ListUsers(env.DB, f)
+	switch err {
+	case nil:
+	case domain.ErrInvalidSort, domain.ErrInvalidCursor:
+		return serror.NewBadRequest(err, "domain.ListUsers", err.Error())
+	default:
+		return serror.NewServer(err, "domain.ListUsers")
+	}
+	return sendJSON(w, list)
+}
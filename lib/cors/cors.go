@@ -0,0 +1,136 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var defAllowedHeaders = []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-Request-ID"}
+
+// Config is a CORS policy
+type Config struct {
+	// AllowedOrigins are exact origins such as https://app.radica.com or
+	// wildcard subdomains such as https://*.radica.com. * allows any origin
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedHeaders   []string `json:"allowed_headers"` // request headers, defaults to defAllowedHeaders
+	ExposedHeaders   []string `json:"exposed_headers"` // response headers scripts may read
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"` // seconds a preflight response may be cached
+}
+
+// Policy applies a CORS config to requests
+type Policy struct {
+	conf     Config
+	any      bool
+	exact    map[string]bool
+	suffixes []wildcard
+	methods  func(path string) string
+}
+
+// wildcard is a https://*.radica.com origin
+type wildcard struct {
+	scheme string
+	suffix string // .radica.com
+}
+
+// New returns a policy for conf. methods returns the methods allowed on a
+// path, as RouteTable.Methods does
+func New(conf Config, methods func(path string) string) (*Policy, error) {
+	if conf.MaxAge < 0 {
+		return nil, fmt.Errorf("cors max_age must not be negative")
+	}
+	if len(conf.AllowedHeaders) == 0 {
+		conf.AllowedHeaders = defAllowedHeaders
+	}
+	p := Policy{conf: conf, exact: make(map[string]bool), methods: methods}
+	for _, o := range conf.AllowedOrigins {
+		o = strings.ToLower(strings.TrimRight(strings.TrimSpace(o), "/"))
+		switch {
+		case o == "*":
+			p.any = true
+		case strings.Contains(o, "*"):
+			i := strings.Index(o, "://*.")
+			if i < 0 || strings.Contains(o[i+5:], "*") || o[i+5:] == "" {
+				return nil, fmt.Errorf("cors origin %q must be scheme://*.domain", o)
+			}
+			p.suffixes = append(p.suffixes, wildcard{scheme: o[:i], suffix: o[i+4:]})
+		case o != "":
+			p.exact[o] = true
+		}
+	}
+	// browsers reject credentials with *, and reflecting any origin with
+	// credentials lets every site act as the user
+	if p.any && conf.AllowCredentials {
+		return nil, fmt.Errorf("cors allow_credentials can not be used with the * origin")
+	}
+	return &p, nil
+}
+
+// Allowed returns true if origin may make cross origin requests
+func (p *Policy) Allowed(origin string) bool {
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	for _, w := range p.suffixes {
+		host := strings.TrimPrefix(origin, w.scheme+"://")
+		if host != origin && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler is middleware that sets the CORS headers and answers preflight
+// requests without calling next
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.Allowed(origin) {
+			if preflight {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p.any {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.conf.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(p.conf.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(p.conf.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", p.methods(r.URL.Path))
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.conf.AllowedHeaders, ", "))
+		if p.conf.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(p.conf.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
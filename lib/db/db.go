@@ -80,6 +80,12 @@ type Storer interface {
 	Transactor
 }
 
+// QueryExecer is a db or transaction that can query and execute
+type QueryExecer interface {
+	Queryer
+	Execer
+}
+
 // Transactor is an interface that creates transactions
 type Transactor interface {
 	Beginx() (*sqlx.Tx, error)
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose forwarding headers are believed.
+// It is set once at startup
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the proxies, as ips or cidrs, whose X-Forwarded-For
+// and X-Real-IP headers are believed by ClientIP
+func SetTrustedProxies(proxies []string) error {
+	nets := []*net.IPNet{}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// ClientIP returns the ip address of the client. Forwarding headers are only
+// used when the request came through trusted proxies, the client is the
+// first address not belonging to one
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trusted(ip) {
+		return ip
+	}
+	fwd := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(fwd[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			return ip
+		}
+		if !trusted(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" && net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+func trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,21 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
 	"github.com/rajendraventurit/radicaapi/lib/serror"
+	"github.com/rajendraventurit/radicaapi/lib/token"
 )
 
 // HFunc is a handler function
 type HFunc func(e *env.Env, w http.ResponseWriter, r *http.Request) error
 
+// AuthHFunc is a handler function for routes that require a token
+type AuthHFunc func(e *env.Env, p *token.Principal, w http.ResponseWriter, r *http.Request) error
+
 // Handler for http handlers
 type Handler struct {
 	Env *env.Env
@@ -17,16 +23,55 @@ type Handler struct {
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := h.Fn(h.Env, w, r)
+	handleErr(w, r, h.Fn(h.Env, w, r))
+}
+
+// AuthHandler for http handlers that require an authenticated principal.
+// The principal is set on the request context by the token middleware
+type AuthHandler struct {
+	Env *env.Env
+	Fn  AuthHFunc
+}
+
+func (h AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := Principal(r)
 	if err != nil {
-		switch err.(type) {
-		case serror.Errorer:
-			err.(serror.Error).Log(0, r)
-			err.(serror.Error).Send(w)
-		default:
-			se := serror.NewCode(http.StatusInternalServerError, err)
-			se.Log(0, r)
-			se.Send(w)
-		}
+		handleErr(w, r, err)
+		return
+	}
+	handleErr(w, r, h.Fn(h.Env, p, w, r))
+}
+
+// Principal returns the authenticated principal of the request
+func Principal(r *http.Request) (*token.Principal, error) {
+	p, ok := token.FromContext(r.Context())
+	if !ok {
+		return nil, serror.New(http.StatusUnauthorized, fmt.Errorf("no principal in request context"), "handler.Principal")
+	}
+	return p, nil
+}
+
+// Param returns the path parameter name of the request, or "" if the
+// route has no such parameter
+func Param(r *http.Request, name string) string {
+	return routetable.ParamsFromContext(r.Context()).ByName(name)
+}
+
+func handleErr(w http.ResponseWriter, r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	var uid int64
+	if p, ok := token.FromContext(r.Context()); ok {
+		uid = p.UserID
+	}
+	switch err.(type) {
+	case serror.Errorer:
+		err.(serror.Error).Log(uid, r)
+		err.(serror.Error).Send(w)
+	default:
+		se := serror.NewCode(http.StatusInternalServerError, err)
+		se.Log(uid, r)
+		se.Send(w)
 	}
 }
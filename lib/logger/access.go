@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessCombined = "combined" // Combined Log Format followed by duration, request id and route
+	AccessJSON     = "json"     // one json object per line
+)
+
+type accessConfig struct {
+	Format string `json:"format"`
+	// Sample is the fraction of successful requests logged for noisy routes,
+	// keyed by method and route path such as "POST /api/v1/user/activity".
+	// Failed requests are always logged
+	Sample map[string]float64 `json:"sample"`
+}
+
+func (c accessConfig) valid() error {
+	switch c.Format {
+	case "", AccessCombined, AccessJSON:
+	default:
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+	for k, v := range c.Sample {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("access log sample for %q must be between 0 and 1", k)
+		}
+	}
+	return nil
+}
+
+// Access is a completed request
+type Access struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id,omitempty"`
+	ClientIP  string        `json:"client_ip"`
+	UserID    int64         `json:"user_id,omitempty"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Route     string        `json:"route,omitempty"` // the route name
+	Path      string        `json:"-"`               // the route path, used for sampling
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+// LogAccess writes a completed request to the default log
+func LogAccess(a Access) {
+	localLog.Access(a)
+}
+
+// Access writes a completed request to the log regardless of log level
+func (l Logger) Access(a Access) {
+	if !l.sampled(a) {
+		return
+	}
+	if l.access.Format == AccessJSON {
+		js, err := json.Marshal(struct {
+			Access
+			DurationMS float64 `json:"duration_ms"`
+		}{a, a.Duration.Seconds() * 1000})
+		if err != nil {
+			l.Error(fmt.Sprintf("json.Marshal access %v", err))
+			return
+		}
+		l.writeLine(string(js) + "\n")
+		return
+	}
+	user := "-"
+	if a.UserID > 0 {
+		user = strconv.FormatInt(a.UserID, 10)
+	}
+	size := "-"
+	if a.Bytes > 0 {
+		size = strconv.FormatInt(a.Bytes, 10)
+	}
+	l.writeLine(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %dms %s \"%s\"\n",
+		a.ClientIP, user, a.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		a.Method, quote(a.URI), a.Proto, a.Status, size, quote(a.Referer), quote(a.UserAgent),
+		a.Duration.Milliseconds(), dash(a.RequestID), quote(a.Route),
+	))
+}
+
+// sampled returns true if the request should be logged
+func (l Logger) sampled(a Access) bool {
+	if a.Status >= 400 {
+		return true
+	}
+	rate, ok := l.access.Sample[a.Method+" "+a.Path]
+	if !ok {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// quote escapes a field written between quotes, an empty field is -
+func quote(s string) string {
+	return dash(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+)
+
+// RequestIDHeader is the header a request id is read from and echoed in
+const RequestIDHeader = "X-Request-ID"
+
+type ctxKey int
+
+const requestIDKey ctxKey = 0
+
+// NewContext returns a context carrying a request id. Messages logged with
+// the context, or a request made with it, include the id
+func NewContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the request id stored in the context, or ""
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRequestID prefixes msg with the request id of ctx, if it has one
+func WithRequestID(ctx context.Context, msg string) string {
+	if id := RequestID(ctx); id != "" {
+		return fmt.Sprintf("RequestID %s %s", id, msg)
+	}
+	return msg
+}
+
+// ErrorfContext will write a formatted error with the request id of ctx
+func ErrorfContext(ctx context.Context, format string, ii ...interface{}) {
+	Error(WithRequestID(ctx, fmt.Sprintf(format, ii...)))
+}
+
+// WarningfContext will write a formatted warning with the request id of ctx
+func WarningfContext(ctx context.Context, format string, ii ...interface{}) {
+	Warning(WithRequestID(ctx, fmt.Sprintf(format, ii...)))
+}
+
+// InfofContext will write a formatted info message with the request id of ctx
+func InfofContext(ctx context.Context, format string, ii ...interface{}) {
+	Info(WithRequestID(ctx, fmt.Sprintf(format, ii...)))
+}
+
+// DebugfContext will write a formatted debug message with the request id of ctx
+func DebugfContext(ctx context.Context, format string, ii ...interface{}) {
+	Debug(WithRequestID(ctx, fmt.Sprintf(format, ii...)))
+}
+
+// MessagefContext will write a formatted message with the request id of ctx
+// regardless of log level
+func MessagefContext(ctx context.Context, format string, ii ...interface{}) {
+	Message(WithRequestID(ctx, fmt.Sprintf(format, ii...)))
+}
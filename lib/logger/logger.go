@@ -23,6 +23,7 @@ type Logger struct {
 	path         string
 	logLevel     LogLevel
 	slackWebHook string
+	access       accessConfig
 }
 
 // LogLevel controls what items are written to the log
@@ -38,35 +39,51 @@ const (
 )
 
 type config struct {
-	Path         string `json:"path"`
-	Level        string `json:"level"`
-	SlackWebHook string `json:"slack_webhook"`
+	Path         string       `json:"path"`
+	Level        string       `json:"level"`
+	SlackWebHook string       `json:"slack_webhook"`
+	Access       accessConfig `json:"access"`
 }
 
-// Configure will configure the logger using the config defConfPath
+// Configure will configure the logger using the config defConfPath, a
+// missing file is not an error. The LOG_PATH, LEVEL and SLACKWEBHOOK
+// environment variables take precedence over the file.
 // logger will attempt to open and write to the log file on each call
 func Configure() error {
+	conf := config{}
 	f, err := os.Open(defConfPath)
-	if err != nil {
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
 		return err
+	default:
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&conf); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
 
-	conf := config{}
-	err = json.NewDecoder(f).Decode(&conf)
-	if err != nil {
+	if err := conf.Access.valid(); err != nil {
 		return err
 	}
-
 	l := Logger{
-		path:         os.Getenv("PATH"),
-		logLevel:     logLevelFromStr(os.Getenv("LEVEL")),
-		slackWebHook: os.Getenv("SLACKWEBHOOK"),
+		path:         envOr("LOG_PATH", conf.Path),
+		logLevel:     logLevelFromStr(envOr("LEVEL", conf.Level)),
+		slackWebHook: envOr("SLACKWEBHOOK", conf.SlackWebHook),
+		access:       conf.Access,
 	}
 	localLog = &l
 	return nil
 }
 
+// envOr returns the environment variable key if it is set, otherwise def
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func logLevelFromStr(l string) LogLevel {
 	switch l {
 	case "ALL":
@@ -113,7 +130,7 @@ func GenHTTPMsg(userid int64, r *http.Request, msg string) string {
 	case r == nil:
 		return fmt.Sprintf("UserID %v %s", userid, msg)
 	default:
-		return GenMsg(userid, r.Method, r.URL.String(), msg)
+		return WithRequestID(r.Context(), GenMsg(userid, r.Method, r.URL.String(), msg))
 	}
 }
 
@@ -191,7 +208,7 @@ func ErrorErr(userid int64, r *http.Request, err error, context ...string) {
 	case r == nil:
 		localLog.Error(fmt.Sprintf("UserID %v %v %v", userid, con, err))
 	default:
-		localLog.Error(GenMsgErr(userid, r.Method, r.URL.String(), err, context...))
+		localLog.Error(WithRequestID(r.Context(), GenMsgErr(userid, r.Method, r.URL.String(), err, context...)))
 	}
 }
 
@@ -252,8 +269,10 @@ func (l Logger) HTTPAccess(userid int64, r *http.Request) {
 }
 
 func (l Logger) write(prefix, msg string) {
-	str := fmt.Sprintf("%s [%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), prefix, msg)
+	l.writeLine(fmt.Sprintf("%s [%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), prefix, msg))
+}
 
+func (l Logger) writeLine(str string) {
 	if l.path != "" {
 		f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
@@ -0,0 +1,283 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defConfPath = "/etc/radica/oidc.json"
+
+// ErrUnknownProvider is returned for a provider that is not configured
+var ErrUnknownProvider = fmt.Errorf("Unknown identity provider")
+
+var (
+	mu        sync.RWMutex
+	providers map[string]*Provider
+	client    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Provider is an OpenID Connect identity provider. Endpoints are read from
+// the issuer's discovery document on first use
+type Provider struct {
+	Name         string   `json:"-"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	LinkByEmail  bool     `json:"link_by_email"` // link to an existing user with the same verified email
+	AllowSignup  bool     `json:"allow_signup"`  // create users for unknown identities with a verified email
+
+	mu   sync.Mutex
+	disc *discovery
+	keys *keySet
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type config struct {
+	Providers map[string]*Provider `json:"providers"`
+}
+
+// Configure will configure the providers using the defConfPath
+func Configure() error {
+	f, err := os.Open(defConfPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conf := config{}
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	providers = make(map[string]*Provider)
+	for name, p := range conf.Providers {
+		if err := p.init(name); err != nil {
+			return err
+		}
+		providers[name] = p
+	}
+	return nil
+}
+
+// AddProvider registers a provider, replacing one with the same name
+func AddProvider(name string, p *Provider) error {
+	if err := p.init(name); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if providers == nil {
+		providers = make(map[string]*Provider)
+	}
+	providers[name] = p
+	return nil
+}
+
+// SetHTTPClient replaces the client used to talk to providers
+func SetHTTPClient(c *http.Client) {
+	mu.Lock()
+	defer mu.Unlock()
+	client = c
+}
+
+// GetProvider returns a configured provider
+func GetProvider(name string) (*Provider, error) {
+	if err := configured(); err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Providers returns the names of the configured providers
+func Providers() []string {
+	names := []string{}
+	if err := configured(); err != nil {
+		return names
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func configured() error {
+	mu.RLock()
+	ok := providers != nil
+	mu.RUnlock()
+	if ok {
+		return nil
+	}
+	return Configure()
+}
+
+func httpClient() *http.Client {
+	mu.RLock()
+	defer mu.RUnlock()
+	return client
+}
+
+func (p *Provider) init(name string) error {
+	if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+		return fmt.Errorf("provider %s requires issuer, client_id and redirect_url", name)
+	}
+	p.Name = name
+	p.Issuer = strings.TrimRight(p.Issuer, "/")
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	return nil
+}
+
+// discover returns the provider's discovery document
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.disc != nil {
+		return p.disc, nil
+	}
+	d := discovery{}
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("provider %s discovery issuer %q does not match %q", p.Name, d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("provider %s discovery is missing endpoints", p.Name)
+	}
+	p.disc = &d
+	return p.disc, nil
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = Random(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Random returns n random bytes url encoded, for state and nonce values
+func Random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthURL returns the url to send the user to for an authorization code
+func (p *Provider) AuthURL(state, nonce, challenge string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(p.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens and returns the
+// verified claims of the id token
+func (p *Provider) Exchange(code, verifier, nonce string) (*Claims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("code_verifier", verifier)
+	if p.ClientSecret == "" {
+		v.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("provider %s token endpoint %s %s", p.Name, resp.Status, body)
+	}
+	tr := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, err
+	}
+	if tr.IDToken == "" {
+		return nil, fmt.Errorf("provider %s returned no id_token", p.Name)
+	}
+	return p.Verify(tr.IDToken, nonce)
+}
+
+func getJSON(u string, i interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(i)
+}
@@ -0,0 +1,260 @@
+package oidc_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rajendraventurit/radicaapi/lib/oidc"
+	"github.com/rajendraventurit/radicaapi/lib/oidc/oidctest"
+)
+
+var alice = oidctest.Identity{
+	Subject:       "alice-1",
+	Email:         "Alice@example.com",
+	EmailVerified: true,
+	GivenName:     "Alice",
+	FamilyName:    "Smith",
+}
+
+func newProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+	srv, err := oidctest.NewServer("radica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	oidc.SetHTTPClient(srv.Client())
+	p := &oidc.Provider{
+		Issuer:      srv.URL + "/",
+		ClientID:    "radica",
+		RedirectURL: "https://app.example.com/oidc/callback",
+	}
+	if err := oidc.AddProvider("stub", p); err != nil {
+		t.Fatal(err)
+	}
+	return srv, p
+}
+
+// login runs an authorization code flow and returns the verified claims
+func login(t *testing.T, srv *oidctest.Server, p *oidc.Provider, nonce string) (*oidc.Claims, error) {
+	t.Helper()
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL("state-1", nonce, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state, err := srv.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "state-1" {
+		t.Fatalf("state %q, want state-1", state)
+	}
+	return p.Exchange(code, verifier, nonce)
+}
+
+func TestDiscovery(t *testing.T) {
+	srv, p := newProvider(t)
+	got, err := oidc.GetProvider("stub")
+	if err != nil || got != p {
+		t.Fatalf("GetProvider = %v, %v", got, err)
+	}
+	authURL, err := p.AuthURL("abc", "def", "ghi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, srv.URL+"/authorize?") {
+		t.Errorf("auth url %s does not use the discovered endpoint", authURL)
+	}
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "radica",
+		"redirect_uri":          p.RedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "abc",
+		"nonce":                 "def",
+		"code_challenge":        "ghi",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("auth url %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	srv, _ := newProvider(t)
+	p := &oidc.Provider{Issuer: srv.URL + "/other", ClientID: "radica", RedirectURL: "https://app.example.com"}
+	if err := oidc.AddProvider("other", p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AuthURL("a", "b", "c"); err == nil {
+		t.Error("discovery with a different issuer succeeded")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	srv, p := newProvider(t)
+	claims, err := login(t, srv, p, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != alice.Subject || claims.Email != alice.Email || !bool(claims.EmailVerified) {
+		t.Errorf("claims %+v do not match %+v", claims, alice)
+	}
+	if claims.GivenName != "Alice" || claims.FamilyName != "Smith" {
+		t.Errorf("claims names %q %q", claims.GivenName, claims.FamilyName)
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	srv, p := newProvider(t)
+	_, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL("state", "nonce", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := srv.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, other, "nonce"); err == nil {
+		t.Error("exchange with the wrong code verifier succeeded")
+	}
+}
+
+func TestExchangeNonce(t *testing.T) {
+	srv, p := newProvider(t)
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL("state", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := srv.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, verifier, "nonce-2"); err == nil {
+		t.Error("exchange with another login's nonce succeeded")
+	}
+}
+
+func TestExchangeCodeReuse(t *testing.T) {
+	srv, p := newProvider(t)
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL("state", "nonce", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := srv.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, verifier, "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, verifier, "nonce"); err == nil {
+		t.Error("exchange reused a code")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv, p := newProvider(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() jwt.MapClaims { return srv.Claims(alice, "nonce") }
+	with := func(k string, v interface{}) jwt.MapClaims {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		kid    string
+		claims jwt.MapClaims
+		raw    string
+		ok     bool
+	}{
+		{name: "valid", claims: valid(), ok: true},
+		{name: "no kid with one key", kid: "-", claims: valid(), ok: true},
+		{name: "audience list", claims: with("aud", []string{"other", "radica"}), ok: true},
+		{name: "string email_verified", claims: with("email_verified", "true"), ok: true},
+		{name: "wrong key", key: other, claims: valid()},
+		{name: "unknown kid", kid: "rotated", claims: valid()},
+		{name: "hs256", raw: hs256},
+		{name: "wrong nonce", claims: with("nonce", "other")},
+		{name: "no nonce", claims: with("nonce", nil)},
+		{name: "wrong issuer", claims: with("iss", "https://evil.example.com")},
+		{name: "wrong audience", claims: with("aud", "other")},
+		{name: "no subject", claims: with("sub", "")},
+		{name: "expired", claims: with("exp", time.Now().Add(-time.Hour).Unix())},
+		{name: "no expiry", claims: with("exp", nil)},
+		{name: "issued in the future", claims: with("iat", time.Now().Add(time.Hour).Unix())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tt.raw
+			if raw == "" {
+				key, kid := tt.key, tt.kid
+				if key == nil {
+					key = srv.Key
+				}
+				if kid == "" {
+					kid = oidctest.KeyID
+				}
+				tok := jwt.NewWithClaims(jwt.SigningMethodRS256, tt.claims)
+				if kid != "-" {
+					tok.Header["kid"] = kid
+				}
+				var err error
+				if raw, err = tok.SignedString(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			claims, err := p.Verify(raw, "nonce")
+			if tt.ok && err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("Verify accepted %+v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Package oidctest is a stub OpenID Connect identity provider for tests. It
+// serves discovery, a JWKS and a token endpoint that checks PKCE and returns
+// RS256 id tokens
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// KeyID is the kid of the key id tokens are signed with
+const KeyID = "test-key"
+
+// Identity is the user the provider logs in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// Server is a stub identity provider
+type Server struct {
+	*httptest.Server
+	ClientID string
+	Key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+type grant struct {
+	ident     Identity
+	nonce     string
+	challenge string
+	redirect  string
+}
+
+// NewServer starts a provider for clientID, call Close when done
+func NewServer(clientID string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{ClientID: clientID, Key: key, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("/jwks", s.handleJWKS)
+	mux.HandleFunc("/token", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// Authorize logs ident in at the auth url, as the user's browser would, and
+// returns the code and state the provider redirects back with
+func (s *Server) Authorize(authURL string, ident Identity) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" {
+		return "", "", fmt.Errorf("bad authorization request %v", q)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", "", fmt.Errorf("authorization request without PKCE")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	code = base64.RawURLEncoding.EncodeToString(b)
+	s.mu.Lock()
+	s.codes[code] = grant{
+		ident:     ident,
+		nonce:     q.Get("nonce"),
+		challenge: q.Get("code_challenge"),
+		redirect:  q.Get("redirect_uri"),
+	}
+	s.mu.Unlock()
+	return code, q.Get("state"), nil
+}
+
+// Claims returns valid id token claims for ident
+func (s *Server) Claims(ident Identity, nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            s.URL,
+		"sub":            ident.Subject,
+		"aud":            s.ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          ident.Email,
+		"email_verified": ident.EmailVerified,
+		"given_name":     ident.GivenName,
+		"family_name":    ident.FamilyName,
+	}
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := s.Key.PublicKey
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": KeyID,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("redirect_uri") != g.redirect:
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		http.Error(w, `{"error": "invalid_grant", "error_description": "PKCE verification failed"}`, http.StatusBadRequest)
+		return
+	}
+	if id, _, ok := r.BasicAuth(); !ok && r.PostForm.Get("client_id") != s.ClientID || ok && id != s.ClientID {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, s.Claims(g.ident, g.nonce))
+	t.Header["kid"] = KeyID
+	tok, err := t.SignedString(s.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": tok})
+}
+
+func writeJSON(w http.ResponseWriter, i interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(i)
+}
@@ -0,0 +1,194 @@
+package oidc
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	keysTTL     = time.Hour       // how long a provider's keys are cached
+	keysRefresh = time.Minute     // minimum time between fetches for an unknown kid
+	clockSkew   = 2 * time.Minute // allowed difference from the provider's clock
+)
+
+// Claims are the id token claims used to identify a user
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf,omitempty"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified boolish  `json:"email_verified"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+}
+
+// Valid checks the time based claims, it is called when the token is parsed
+func (c Claims) Valid() error {
+	now := time.Now().Unix()
+	skew := int64(clockSkew.Seconds())
+	if c.ExpiresAt == 0 || now > c.ExpiresAt+skew {
+		return fmt.Errorf("id token is expired")
+	}
+	if c.IssuedAt > now+skew || c.NotBefore > now+skew {
+		return fmt.Errorf("id token is not valid yet")
+	}
+	return nil
+}
+
+// audience is a string or array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// boolish is a bool some providers send as a string
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// Verify checks an id token's RS256 signature against the provider's keys,
+// its issuer, audience, times and nonce
+func (p *Provider) Verify(raw, nonce string) (*Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("id token issuer %q does not match %q", claims.Issuer, p.Issuer)
+	}
+	if !claims.Audience.contains(p.ClientID) {
+		return nil, fmt.Errorf("id token audience does not include %q", p.ClientID)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("id token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+	return &claims, nil
+}
+
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// key returns the provider's key for kid, fetching the JWKS when it is stale
+// or the kid is unknown, providers rotate keys
+func (p *Provider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ks := p.keys
+	if ks != nil && time.Since(ks.fetched) < keysTTL {
+		if k := ks.find(kid); k != nil {
+			return k, nil
+		}
+		if time.Since(ks.fetched) < keysRefresh {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+	}
+	ks, err = fetchKeys(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = ks
+	if k := ks.find(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// find returns the key for kid, a token without a kid may use the only key
+func (ks keySet) find(kid string) *rsa.PublicKey {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k
+		}
+	}
+	return ks.keys[kid]
+}
+
+func fetchKeys(uri string) (*keySet, error) {
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := getJSON(uri, &jwks); err != nil {
+		return nil, err
+	}
+	ks := keySet{keys: make(map[string]*rsa.PublicKey), fetched: time.Now()}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q modulus %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %q exponent %v", k.Kid, err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q exponent too large", k.Kid)
+		}
+		ks.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	}
+	return &ks, nil
+}
@@ -0,0 +1,210 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defConfPath = "/etc/radica/password.json"
+
+// Hash algorithms
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// ErrMismatch is returned when a password does not match its hash
+var ErrMismatch = fmt.Errorf("password does not match")
+
+// ErrUnknownHash is returned for a hash in an unrecognized format
+var ErrUnknownHash = fmt.Errorf("unknown password hash format")
+
+var (
+	mu        sync.RWMutex
+	localConf = defaultConfig()
+)
+
+type config struct {
+	Algorithm string       `json:"algorithm"` // algorithm for new hashes
+	Bcrypt    bcryptParams `json:"bcrypt"`
+	Argon2id  argonParams  `json:"argon2id"`
+}
+
+type bcryptParams struct {
+	Cost int `json:"cost"`
+}
+
+type argonParams struct {
+	Memory      uint32 `json:"memory_kib"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+	SaltLength  uint32 `json:"salt_length"`
+	KeyLength   uint32 `json:"key_length"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Algorithm: Argon2id,
+		Bcrypt:    bcryptParams{Cost: bcrypt.DefaultCost},
+		Argon2id: argonParams{
+			Memory:      19 * 1024,
+			Iterations:  2,
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+// Configure will configure the hash parameters using the defConfPath
+func Configure() error {
+	f, err := os.Open(defConfPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conf := defaultConfig()
+	if err := json.NewDecoder(f).Decode(conf); err != nil {
+		return err
+	}
+	switch conf.Algorithm {
+	case Bcrypt, Argon2id:
+	default:
+		return fmt.Errorf("unknown password algorithm %q", conf.Algorithm)
+	}
+	if conf.Bcrypt.Cost < bcrypt.MinCost || conf.Bcrypt.Cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	a := conf.Argon2id
+	if a.Memory < 8*uint32(a.Parallelism) || a.Iterations < 1 || a.Parallelism < 1 || a.SaltLength < 8 || a.KeyLength < 16 {
+		return fmt.Errorf("argon2id parameters are invalid")
+	}
+	mu.Lock()
+	localConf = conf
+	mu.Unlock()
+	return nil
+}
+
+func current() *config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return localConf
+}
+
+// Hash returns the hash of a password using the configured algorithm.
+// argon2id hashes are PHC strings, bcrypt hashes use bcrypt's own format
+func Hash(pass string) (string, error) {
+	conf := current()
+	if conf.Algorithm == Bcrypt {
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), conf.Bcrypt.Cost)
+		return string(h), err
+	}
+	p := conf.Argon2id
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare returns nil if pass matches hash, ErrMismatch if it does not
+func Compare(hash, pass string) error {
+	switch algorithm(hash) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrMismatch
+		}
+		return err
+	case Argon2id:
+		p, salt, key, err := decodeArgon(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(pass), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+	return ErrUnknownHash
+}
+
+// NeedsRehash returns true if hash was not made with the configured
+// algorithm and parameters
+func NeedsRehash(hash string) bool {
+	conf := current()
+	alg := algorithm(hash)
+	if alg != conf.Algorithm {
+		return true
+	}
+	if alg == Bcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != conf.Bcrypt.Cost
+	}
+	p, _, key, err := decodeArgon(hash)
+	if err != nil {
+		return true
+	}
+	want := conf.Argon2id
+	return p.Memory != want.Memory || p.Iterations != want.Iterations ||
+		p.Parallelism != want.Parallelism || uint32(len(key)) != want.KeyLength
+}
+
+func algorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	}
+	return ""
+}
+
+// decodeArgon parses $argon2id$v=19$m=19456,t=2,p=1$salt$key
+func decodeArgon(hash string) (argonParams, []byte, []byte, error) {
+	p := argonParams{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %v", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if p.Iterations < 1 || p.Parallelism < 1 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
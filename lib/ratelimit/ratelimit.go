@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defConfPath = "/etc/radica/ratelimit.json"
+
+var (
+	mu        sync.RWMutex
+	localConf = defaultConfig()
+)
+
+type config struct {
+	Default Limit `json:"default"` // used by routes without a limit of their own
+	IP      Limit `json:"ip"`      // every request from an ip, checked before authentication
+}
+
+func defaultConfig() *config {
+	return &config{
+		Default: Limit{Requests: 300, Seconds: 60, Burst: 60},
+		IP:      Limit{Requests: 1200, Seconds: 60, Burst: 240},
+	}
+}
+
+// Limit is a token bucket. It refills at Requests every Seconds and holds
+// up to Burst tokens, each request takes one
+type Limit struct {
+	Requests int `json:"requests"`
+	Seconds  int `json:"seconds"`
+	Burst    int `json:"burst"` // defaults to Requests
+}
+
+func (l Limit) valid() error {
+	if l.Requests < 1 || l.Seconds < 1 || l.Burst < 0 {
+		return fmt.Errorf("rate limit requests and seconds must be greater than zero")
+	}
+	return nil
+}
+
+// rate returns the tokens added per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / float64(l.Seconds)
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// Result is the state of a bucket after a request
+type Result struct {
+	Allowed    bool
+	Limit      int           // the size of the bucket
+	Remaining  int           // requests that may be made now
+	Reset      time.Duration // until the bucket is full
+	RetryAfter time.Duration // until a request is allowed, zero if Allowed
+}
+
+// SetHeaders sets the RateLimit headers of the result, and Retry-After if
+// the request was refused
+func (r Result) SetHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(r.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", strconv.FormatInt(seconds(r.Reset), 10))
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(seconds(r.RetryAfter), 10))
+	}
+}
+
+// seconds rounds d up to whole seconds
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// Store holds token buckets. A store shared between servers makes limits
+// apply across them. Implementations must be safe for concurrent use
+type Store interface {
+	// Take takes a token from the bucket key, creating it full if it does
+	// not exist
+	Take(key string, l Limit, now time.Time) (Result, error)
+}
+
+// Limiter applies limits to requests
+type Limiter struct {
+	store Store
+}
+
+// New returns a limiter that keeps its buckets in store
+func New(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Allow takes a request for key from the bucket of l. The configured
+// default limit is used if l is nil
+func (lm *Limiter) Allow(key string, l *Limit) (Result, error) {
+	lim := current().Default
+	if l != nil {
+		lim = *l
+	}
+	if err := lim.valid(); err != nil {
+		return Result{}, err
+	}
+	return lm.store.Take(key, lim, time.Now())
+}
+
+// Configure will configure the default limit using the defConfPath
+func Configure() error {
+	f, err := os.Open(defConfPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conf := defaultConfig()
+	if err := json.NewDecoder(f).Decode(conf); err != nil {
+		return err
+	}
+	if err := conf.Default.valid(); err != nil {
+		return err
+	}
+	if err := conf.IP.valid(); err != nil {
+		return fmt.Errorf("ip %v", err)
+	}
+	mu.Lock()
+	localConf = conf
+	mu.Unlock()
+	return nil
+}
+
+// IPLimit returns the configured limit for all requests from an ip
+func IPLimit() *Limit {
+	l := current().IP
+	return &l
+}
+
+func current() *config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return localConf
+}
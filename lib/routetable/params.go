@@ -0,0 +1,94 @@
+package routetable
+
+import (
+	"context"
+	"strings"
+)
+
+// Param is a path parameter
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Params are the path parameters of a request in the order of the pattern
+type Params []Param
+
+// ByName returns the value of the parameter name, or "" if it is not set
+func (ps Params) ByName(name string) string {
+	for _, p := range ps {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+type ctxKey int
+
+const (
+	paramsKey ctxKey = iota
+	routeKey
+)
+
+// NewParamsContext returns a context carrying path parameters
+func NewParamsContext(ctx context.Context, ps Params) context.Context {
+	return context.WithValue(ctx, paramsKey, ps)
+}
+
+// ParamsFromContext returns the path parameters stored in the context
+func ParamsFromContext(ctx context.Context) Params {
+	ps, _ := ctx.Value(paramsKey).(Params)
+	return ps
+}
+
+// NewRouteContext returns a context carrying the matched route
+func NewRouteContext(ctx context.Context, r *Route) context.Context {
+	return context.WithValue(ctx, routeKey, r)
+}
+
+// RouteFromContext returns the matched route stored in the context, or nil
+// if the request matched no route
+func RouteFromContext(ctx context.Context) *Route {
+	r, _ := ctx.Value(routeKey).(*Route)
+	return r
+}
+
+// isPattern returns true if path has parameters
+func isPattern(path string) bool {
+	return strings.ContainsAny(path, ":*")
+}
+
+// matchPath matches path against an httprouter pattern. :name matches one
+// segment, *name matches the rest of the path including its leading slash.
+// Static parts are compared ignoring case, as route lookups are
+func matchPath(pattern, path string) (Params, bool) {
+	var ps Params
+	for {
+		i := strings.IndexAny(pattern, ":*")
+		if i < 0 {
+			return ps, strings.EqualFold(pattern, path)
+		}
+		if len(path) < i || !strings.EqualFold(pattern[:i], path[:i]) {
+			return nil, false
+		}
+		pattern, path = pattern[i:], path[i:]
+		end := strings.IndexByte(pattern, '/')
+		if end < 0 {
+			end = len(pattern)
+		}
+		name := pattern[1:end]
+		if pattern[0] == '*' {
+			return append(ps, Param{Key: name, Value: "/" + path}), true
+		}
+		seg := strings.IndexByte(path, '/')
+		if seg < 0 {
+			seg = len(path)
+		}
+		if seg == 0 {
+			return nil, false
+		}
+		ps = append(ps, Param{Key: name, Value: path[:seg]})
+		pattern, path = pattern[end:], path[seg:]
+	}
+}
@@ -0,0 +1,146 @@
+package routetable
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		ok      bool
+		params  Params
+	}{
+		// static
+		{"/api/v1/user", "/api/v1/user", true, nil},
+		{"/api/v1/user", "/api/v1/user/", false, nil},
+		{"/api/v1/user", "/api/v1/users", false, nil},
+		{"/api/v1/user", "/API/v1/User", true, nil},
+
+		// named parameters match one non empty segment
+		{"/user/:id", "/user/5", true, Params{{"id", "5"}}},
+		{"/user/:id", "/user/", false, nil},
+		{"/user/:id", "/user", false, nil},
+		{"/user/:id", "/user/5/", false, nil},
+		{"/user/:id", "/user/5/roles", false, nil},
+		{"/user/:id/roles", "/user/5/roles", true, Params{{"id", "5"}}},
+		{"/user/:id/roles", "/user/5/roles/1", false, nil},
+		{"/org/:org/user/:user", "/org/1/user/2", true, Params{{"org", "1"}, {"user", "2"}}},
+		{"/org/:org/user/:user", "/org//user/2", false, nil},
+
+		// static parts fold case, parameter values keep it
+		{"/User/:id", "/uSER/AbC", true, Params{{"id", "AbC"}}},
+		{"/user/:id/Roles", "/USER/AbC/roles", true, Params{{"id", "AbC"}}},
+
+		// catch-all parameters match the rest of the path with its slash
+		{"/files/*path", "/files/a/b.txt", true, Params{{"path", "/a/b.txt"}}},
+		{"/files/*path", "/files/", true, Params{{"path", "/"}}},
+		{"/files/*path", "/files", false, nil},
+		{"/files/*path", "/Files/A/", true, Params{{"path", "/A/"}}},
+		{"/files/*path", "/other/a", false, nil},
+		{"/user/:id/*rest", "/user/5/a/b", true, Params{{"id", "5"}, {"rest", "/a/b"}}},
+	}
+	for _, tt := range tests {
+		ps, ok := matchPath(tt.pattern, tt.path)
+		if ok != tt.ok {
+			t.Errorf("matchPath(%q, %q) ok = %v, want %v", tt.pattern, tt.path, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(ps, tt.params) {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, ps, tt.params)
+		}
+	}
+}
+
+// testTable returns routes httprouter accepts, it refuses a static segment
+// and a parameter at the same position such as /user/me and /user/:id
+func testTable() RouteTable {
+	rt := NewRouteTable()
+	rt.Add(
+		Route{Name: "user", Method: "GET", Path: "/api/v1/user/:id"},
+		Route{Name: "update user", Method: "PUT", Path: "/api/v1/user/:id"},
+		Route{Name: "create user", Method: "POST", Path: "/api/v1/user"},
+		Route{Name: "roles", Method: "GET", Path: "/api/v1/user/:id/roles"},
+		Route{Name: "files", Method: "GET", Path: "/api/v1/files/*path"},
+	)
+	return rt
+}
+
+func TestMatch(t *testing.T) {
+	rt := testTable()
+	tests := []struct {
+		method string
+		path   string
+		name   string
+		params Params
+	}{
+		{"GET", "/api/v1/user/5", "user", Params{{"id", "5"}}},
+		{"get", "/API/v1/User/Me", "user", Params{{"id", "Me"}}},
+		{"PUT", "/api/v1/user/5", "update user", Params{{"id", "5"}}},
+		{"PUT", "/api/v1/user/me", "update user", Params{{"id", "me"}}},
+		{"POST", "/api/v1/USER", "create user", nil},
+		{"GET", "/api/v1/user/5/roles", "roles", Params{{"id", "5"}}},
+		{"GET", "/api/v1/files/a/b", "files", Params{{"path", "/a/b"}}},
+		{"GET", "/api/v1/files/", "files", Params{{"path", "/"}}},
+		{"GET", "/api/v1/files", "", nil},
+		{"DELETE", "/api/v1/user/5", "", nil},
+		{"GET", "/api/v1/user/5/", "", nil},
+		{"GET", "/api/v1/nothing", "", nil},
+	}
+	for _, tt := range tests {
+		r, ps, err := rt.Match(tt.method, tt.path)
+		if tt.name == "" {
+			if err == nil {
+				t.Errorf("Match(%s %s) = %q, want no route", tt.method, tt.path, r.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Match(%s %s): %v", tt.method, tt.path, err)
+			continue
+		}
+		if r.Name != tt.name || !reflect.DeepEqual(ps, tt.params) {
+			t.Errorf("Match(%s %s) = %q %v, want %q %v", tt.method, tt.path, r.Name, ps, tt.name, tt.params)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	rt := testTable()
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/user/me", "OPTIONS, GET, PUT"},
+		{"/api/v1/user/5", "OPTIONS, GET, PUT"},
+		{"/api/v1/User", "OPTIONS, POST"},
+		{"/api/v1/user/5/roles", "OPTIONS, GET"},
+		{"/api/v1/files/a", "OPTIONS, GET"},
+		{"/api/v1/files", "OPTIONS"},
+		{"/api/v1/nothing", "OPTIONS"},
+	}
+	for _, tt := range tests {
+		if got := rt.Methods(tt.path); got != tt.want {
+			t.Errorf("Methods(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParamsContext(t *testing.T) {
+	r, err := http.NewRequest("GET", "/api/v1/user/5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps := ParamsFromContext(r.Context()); ps != nil {
+		t.Errorf("params without any set = %v", ps)
+	}
+	ctx := NewParamsContext(r.Context(), Params{{"id", "5"}})
+	if got := ParamsFromContext(ctx).ByName("id"); got != "5" {
+		t.Errorf("ByName(id) = %q, want 5", got)
+	}
+	if got := ParamsFromContext(ctx).ByName("other"); got != "" {
+		t.Errorf("ByName(other) = %q, want empty", got)
+	}
+}
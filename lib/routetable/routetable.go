@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/bouk/httprouter"
+	"github.com/rajendraventurit/radicaapi/lib/ratelimit"
 )
 
 // Route is an endpoint route
@@ -23,12 +24,34 @@ type Route struct {
 	Handler     http.Handler
 	Insecure    bool
 	Permissions []int64
+	Scopes      []string // api key scopes, routes without scopes reject api keys
+	// AllowUnverified lets users who have not verified their email use the
+	// route when the verification policy is restricted
+	AllowUnverified bool
+	// OrgScoped routes act on the organization_id of the request. Permissions
+	// are checked against the caller's roles in that organization
+	OrgScoped bool
+	// Sensitive routes change credentials, account data or who has access and
+	// may not be used with an impersonation token, insecure routes refuse
+	// one if it is sent
+	Sensitive bool
+	// RateLimit limits requests to the route from each client, the
+	// configured default applies if it is nil
+	RateLimit *ratelimit.Limit
+	// Middleware runs for this route only, inside the global and group
+	// middleware
+	Middleware []func(http.Handler) http.Handler
+	group      []func(http.Handler) http.Handler // middleware of combined route tables
 }
 
 // RouteTable is a collection of routes
 type RouteTable struct {
 	Routes []Route
-	hashed map[string]*Route
+	// Middleware runs for every route of the table. It is kept when the
+	// table is combined into another
+	Middleware []func(http.Handler) http.Handler
+	hashed     map[string]*Route
+	patterned  []*Route // routes with path parameters, matched in order
 }
 
 // NewRouteTable returns a new route table
@@ -46,7 +69,12 @@ func (rt *RouteTable) Add(routes ...Route) {
 
 func (rt *RouteTable) hash() {
 	rt.hashed = make(map[string]*Route)
+	rt.patterned = nil
 	for i, r := range rt.Routes {
+		if isPattern(r.Path) {
+			rt.patterned = append(rt.patterned, &rt.Routes[i])
+			continue
+		}
 		key := fmt.Sprintf("%s:%s", strings.ToUpper(r.Method), strings.ToLower(r.Path))
 		rt.hashed[key] = &rt.Routes[i]
 	}
@@ -54,30 +82,56 @@ func (rt *RouteTable) hash() {
 
 // GetRoute will return  a matching route
 func (rt RouteTable) GetRoute(method, path string) (*Route, error) {
+	r, _, err := rt.Match(method, path)
+	return r, err
+}
+
+// Match returns the route matching a request and its path parameters.
+// Static paths are preferred over patterns
+func (rt RouteTable) Match(method, path string) (*Route, Params, error) {
 	key := fmt.Sprintf("%s:%s", strings.ToUpper(method), strings.ToLower(path))
 	if r, ok := rt.hashed[key]; ok {
-		return r, nil
+		return r, nil, nil
 	}
-	return nil, fmt.Errorf("route not found")
+	for _, r := range rt.patterned {
+		if !strings.EqualFold(r.Method, method) {
+			continue
+		}
+		if ps, ok := matchPath(r.Path, path); ok {
+			return r, ps, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("route not found")
 }
 
-// Methods returns the available methods for a path
+// Methods returns the available methods for a path, each once
 func (rt RouteTable) Methods(path string) string {
-	path = strings.ToLower(path)
 	allow := []string{"OPTIONS"}
+	seen := map[string]bool{"OPTIONS": true}
 	for _, r := range rt.Routes {
-		rpath := strings.ToLower(r.Path)
-		if path == rpath {
+		m := strings.ToUpper(r.Method)
+		if _, ok := matchPath(r.Path, path); ok && !seen[m] {
+			seen[m] = true
 			allow = append(allow, r.Method)
 		}
 	}
 	return strings.Join(allow, ", ")
 }
 
-// Combine will add routes to this route table
+// Use adds middleware for every route of the table
+func (rt *RouteTable) Use(fns ...func(http.Handler) http.Handler) {
+	rt.Middleware = append(rt.Middleware, fns...)
+}
+
+// Combine will add routes to this route table. Each route keeps the
+// middleware of the table it came from
 func (rt *RouteTable) Combine(newrt ...RouteTable) {
 	for _, r := range newrt {
-		rt.Routes = append(rt.Routes, r.Routes...)
+		for _, route := range r.Routes {
+			group := append([]func(http.Handler) http.Handler{}, r.Middleware...)
+			route.group = append(group, route.group...)
+			rt.Routes = append(rt.Routes, route)
+		}
 	}
 	rt.hash()
 }
@@ -100,7 +154,8 @@ func NewRouter() *Router {
 	return &router
 }
 
-// AddMiddleware adds a middleware
+// AddMiddleware adds a global middleware. It runs for every request,
+// including those that match no route. Middleware runs in the order added
 func (r *Router) AddMiddleware(fn func(http.Handler) http.Handler) {
 	r.Middleware = append(r.Middleware, fn)
 }
@@ -110,27 +165,48 @@ func (r *Router) SetRouteTable(rt RouteTable) {
 	r.RouteTable = rt
 }
 
-func (r *Router) addMiddleware() http.Handler {
-	fn := http.Handler(r.Router)
-	for _, h := range r.Middleware {
-		fn = h(fn)
+// Handler returns a handler ready to serve routes. A request runs through
+//  1. the global middleware
+//  2. the route table's middleware
+//  3. the middleware of each combined table, outermost table first
+//  4. the route's middleware
+//  5. the route's handler
+//
+// Each list runs in the order it was added. The matched route and its path
+// parameters are set on the request context before any middleware runs, use
+// RouteFromContext and ParamsFromContext to read them
+func (r Router) Handler() http.Handler {
+	for i := range r.RouteTable.Routes {
+		route := r.RouteTable.Routes[i]
+		mw := append([]func(http.Handler) http.Handler{}, r.RouteTable.Middleware...)
+		mw = append(mw, route.group...)
+		mw = append(mw, route.Middleware...)
+		r.Router.Handle(route.Method, route.Path, chain(route.Handler, mw).ServeHTTP)
 	}
-	return fn
+	return r.resolve(chain(r.Router, r.Middleware))
 }
 
-// Handler returns a handler ready to serve routes
-func (r Router) Handler() http.Handler {
-	for _, route := range r.RouteTable.Routes {
-		fn := http.Handler(route.Handler)
-		r.Router.Handle(route.Method, route.Path, wrapHandler(fn))
-	}
-	return r.addMiddleware()
+// resolve sets the route matching the request and its path parameters on
+// the request context
+func (r Router) resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if route, ps, err := r.RouteTable.Match(req.Method, req.URL.Path); err == nil {
+			ctx := NewRouteContext(req.Context(), route)
+			if len(ps) > 0 {
+				ctx = NewParamsContext(ctx, ps)
+			}
+			req = req.WithContext(ctx)
+		}
+		next.ServeHTTP(w, req)
+	})
 }
 
-func wrapHandler(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		h.ServeHTTP(w, r)
+// chain wraps h in mw so that mw[0] runs first
+func chain(h http.Handler, mw []func(http.Handler) http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
 	}
+	return h
 }
 
 func handle404(w http.ResponseWriter, r *http.Request) {
@@ -199,6 +275,21 @@ func (r Route) GenMDDocumentation() string {
 		}
 		builder.WriteString(fmt.Sprintf("\tOrg Permissions: %s\n", strings.Join(perms, ", ")))
 	}
+	if len(r.Scopes) > 0 {
+		builder.WriteString(fmt.Sprintf("\tAPI key scopes: %s\n", strings.Join(r.Scopes, ", ")))
+	}
+	if r.OrgScoped {
+		builder.WriteString("\tRequires organization_id, permissions are checked in that organization\n")
+	}
+	if r.AllowUnverified {
+		builder.WriteString("\tAvailable before email verification\n")
+	}
+	if r.Sensitive {
+		builder.WriteString("\tNot available while impersonating\n")
+	}
+	if r.RateLimit != nil {
+		builder.WriteString(fmt.Sprintf("\tRate limited to %v requests per %v seconds\n", r.RateLimit.Requests, r.RateLimit.Seconds))
+	}
 	builder.WriteString(fmt.Sprintf("#### Inputs\n"))
 	js := fmtJSON(r.Input)
 	if js != "" {
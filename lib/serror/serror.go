@@ -25,10 +25,11 @@ type Error struct {
 
 //ResponseJSON is the struct
 type ResponseJSON struct {
-	Status  bool        `json:"status"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
-	Code    int         `json:"code"`
+	Status    bool        `json:"status"`
+	Message   string      `json:"message"`
+	Data      interface{} `json:"data,omitempty"`
+	Code      int         `json:"code"`
+	RequestID string      `json:"request_id,omitempty"` // identifies the request in the logs
 }
 
 //NewResponseJSON which returns the response
@@ -91,7 +92,16 @@ func (e Error) Message() string {
 // Send will send the status code and description to the response writer
 func (e Error) Send(w http.ResponseWriter) {
 	msg := fmt.Sprintf("%s %s", e.Status(), e.Message())
-	http.Error(w, msg, e.StatusCode())
+	HTTPError(w, msg, e.StatusCode())
+}
+
+// HTTPError replies with msg and the request id set on the response, so
+// clients can quote it when reporting the error
+func HTTPError(w http.ResponseWriter, msg string, code int) {
+	if id := w.Header().Get(logger.RequestIDHeader); id != "" {
+		msg = fmt.Sprintf("%s (request id %s)", msg, id)
+	}
+	http.Error(w, msg, code)
 }
 
 // Log write to the logger
@@ -107,5 +117,8 @@ func (e Error) Log(userid int64, r *http.Request) {
 	default:
 		msg = fmt.Sprintf("UserID %v %v %v %v", userid, r.Method, r.URL.String(), e.Error())
 	}
+	if r != nil {
+		msg = logger.WithRequestID(r.Context(), msg)
+	}
 	logger.Error(msg)
 }
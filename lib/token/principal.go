@@ -0,0 +1,44 @@
+package token
+
+import "context"
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID    int64
+	Roles     []int64
+	TokenID   string   // jti of the token
+	SessionID int64    // login session of the token
+	Claims    *Claims  // decoded token, nil for api keys
+	APIKeyID  int64    // set when authenticated with an api key
+	Scopes    []string // api key scopes
+	Verified  bool     // the user has verified their email
+	OrgID     int64    // organization of an org scoped route
+	ActorID   int64    // the admin impersonating UserID
+}
+
+type ctxKey int
+
+const principalKey ctxKey = 0
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// FromContext returns the principal stored in the context
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// HasRole returns true if the principal has one of the roles
+func (p Principal) HasRole(roles ...int64) bool {
+	for _, r := range roles {
+		for _, pr := range p.Roles {
+			if r == pr {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package token
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/rajendraventurit/radicaapi/lib/db"
+)
+
+// cacheTTL is how long a lookup is trusted before the db is asked again.
+// Revocations made by this process are visible immediately, revocations
+// made by other servers are visible after at most cacheTTL. A revoked token
+// can therefore be used on another server for up to cacheTTL, tokens of a
+// revoked session are rejected at once by the session check
+const cacheTTL = 5 * time.Second
+
+const maxCache = 10000
+
+var revoked = newRevocationCache()
+
+type revEntry struct {
+	revoked bool
+	checked time.Time
+}
+
+type cutoffEntry struct {
+	before  int64 // unix microseconds, tokens issued at or before are revoked
+	checked time.Time
+}
+
+type revocationCache struct {
+	sync.Mutex
+	tokens map[string]revEntry
+	users  map[int64]cutoffEntry
+}
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{
+		tokens: make(map[string]revEntry),
+		users:  make(map[int64]cutoffEntry),
+	}
+}
+
+// Revoke will revoke a single token
+func Revoke(ex db.Execer, c *Claims) error {
+	if c.Id == "" {
+		return RevokeUser(ex, c.UserID)
+	}
+	str := `
+	INSERT IGNORE INTO revoked_tokens
+		(jti, user_id, expires_on)
+		VALUES
+		(?, ?, ?)
+	`
+	if _, err := ex.Exec(str, c.Id, c.UserID, time.Unix(c.ExpiresAt, 0)); err != nil {
+		return err
+	}
+	revoked.Lock()
+	revoked.tokens[c.Id] = revEntry{revoked: true, checked: time.Now()}
+	revoked.Unlock()
+	return nil
+}
+
+// RevokeUser will revoke every token issued to a user up to now
+func RevokeUser(ex db.Execer, userid int64) error {
+	now := time.Now()
+	str := `
+	INSERT INTO user_token_revocations
+		(user_id, revoked_before)
+		VALUES
+		(?, ?)
+	ON DUPLICATE KEY UPDATE revoked_before = VALUES(revoked_before)
+	`
+	if _, err := ex.Exec(str, userid, now); err != nil {
+		return err
+	}
+	revoked.Lock()
+	revoked.users[userid] = cutoffEntry{before: unixMicro(now), checked: now}
+	revoked.Unlock()
+	return nil
+}
+
+// IsRevoked returns true if the token or all of the user's tokens have been
+// revoked. User revocations are compared in microseconds so tokens issued
+// just after one, such as on the login following a password reset, are valid
+func IsRevoked(qr db.Queryer, c *Claims) (bool, error) {
+	before, err := userCutoff(qr, c.UserID)
+	if err != nil {
+		return false, err
+	}
+	if c.issuedUS() <= before {
+		return true, nil
+	}
+	if c.Id == "" {
+		return false, nil
+	}
+	return tokenRevoked(qr, c.Id)
+}
+
+func userCutoff(qr db.Queryer, userid int64) (int64, error) {
+	now := time.Now()
+	revoked.Lock()
+	e, ok := revoked.users[userid]
+	revoked.Unlock()
+	if ok && now.Sub(e.checked) < cacheTTL {
+		return e.before, nil
+	}
+
+	str := "SELECT revoked_before FROM user_token_revocations WHERE user_id = ?"
+	t := time.Time{}
+	err := qr.Get(&t, str, userid)
+	switch {
+	case err == sql.ErrNoRows:
+		e = cutoffEntry{checked: now}
+	case err != nil:
+		return 0, err
+	default:
+		e = cutoffEntry{before: unixMicro(t), checked: now}
+	}
+	revoked.Lock()
+	revoked.prune(now)
+	revoked.users[userid] = e
+	revoked.Unlock()
+	return e.before, nil
+}
+
+func tokenRevoked(qr db.Queryer, jti string) (bool, error) {
+	now := time.Now()
+	revoked.Lock()
+	e, ok := revoked.tokens[jti]
+	revoked.Unlock()
+	if ok && (e.revoked || now.Sub(e.checked) < cacheTTL) {
+		return e.revoked, nil
+	}
+
+	str := "SELECT count(*) FROM revoked_tokens WHERE jti = ?"
+	cnt := int64(0)
+	if err := qr.Get(&cnt, str, jti); err != nil {
+		return false, err
+	}
+	revoked.Lock()
+	revoked.prune(now)
+	revoked.tokens[jti] = revEntry{revoked: cnt > 0, checked: now}
+	revoked.Unlock()
+	return cnt > 0, nil
+}
+
+// prune drops stale entries once the cache grows past maxCache.
+// Dropped entries are reloaded from the db. Caller must hold the lock
+func (rc *revocationCache) prune(now time.Time) {
+	if len(rc.tokens)+len(rc.users) < maxCache {
+		return
+	}
+	for k, e := range rc.tokens {
+		if now.Sub(e.checked) > cacheTTL {
+			delete(rc.tokens, k)
+		}
+	}
+	for k, e := range rc.users {
+		if now.Sub(e.checked) > cacheTTL {
+			delete(rc.users, k)
+		}
+	}
+}
+
+func unixMicro(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
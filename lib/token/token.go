@@ -1,6 +1,11 @@
 package token
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,21 +18,55 @@ import (
 
 const defConfPath = "/etc/radica/jwt.json"
 
-// Claims is a jwt claims struct
+// Claims is a jwt claims struct. StandardClaims.Id is the jti claim
+// and identifies the token for revocation
 type Claims struct {
-	UserID int64 `json:"user_id,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	SessionID int64  `json:"sid,omitempty"`    // the login session, tokens are rejected once it is revoked
+	Purpose   string `json:"pur,omitempty"`    // set on tokens that may not be used for authentication
+	ActorID   int64  `json:"act,omitempty"`    // the admin impersonating UserID
+	IssuedUS  int64  `json:"iat_us,omitempty"` // issue time in unix microseconds, user revocations are checked against it
 	jwt.StandardClaims
 }
 
+// setIssued sets the issue time claims
+func (c *Claims) setIssued(t time.Time) {
+	c.IssuedAt = t.Unix()
+	c.IssuedUS = unixMicro(t)
+}
+
+// issuedUS returns the issue time in unix microseconds. Tokens without
+// iat_us are treated as issued at the start of their second
+func (c Claims) issuedUS() int64 {
+	if c.IssuedUS > 0 {
+		return c.IssuedUS
+	}
+	return c.IssuedAt * int64(time.Second/time.Microsecond)
+}
+
+// Challenge token purposes
+const (
+	PurposeMFA      = "mfa"      // a two factor code is required
+	PurposePassword = "password" // an expired password must be changed
+)
+
+// challengeTTL is the lifetime of a challenge token
+const challengeTTL = 5 * time.Minute
+
 var localConf *config
 
 type config struct {
-	Secret      string `json:"secret"`
-	key         []byte
-	ExpireHours int `json:"expire_hours"`
-	hours       time.Duration
+	Secret        string `json:"secret"`
+	key           []byte
+	ExpireHours   int `json:"expire_hours"`   // deprecated, used when access_minutes is not set
+	AccessMinutes int `json:"access_minutes"` // lifetime of an access token
+	access        time.Duration
+	RefreshDays   int `json:"refresh_days"` // lifetime of a refresh token
+	refresh       time.Duration
 }
 
+const defRefreshDays = 30
+
 // Configure will configure the logger using the defConfPath
 // logger will attempt to open and write to the log file on each call
 func Configure() error {
@@ -42,10 +81,18 @@ func Configure() error {
 	if err != nil {
 		return err
 	}
-	if conf.ExpireHours < 1 {
-		return fmt.Errorf("expire_hours must be greater than zero")
+	switch {
+	case conf.AccessMinutes > 0:
+		conf.access = time.Duration(conf.AccessMinutes) * time.Minute
+	case conf.ExpireHours > 0:
+		conf.access = time.Duration(conf.ExpireHours) * time.Hour
+	default:
+		return fmt.Errorf("access_minutes must be greater than zero")
+	}
+	if conf.RefreshDays < 1 {
+		conf.RefreshDays = defRefreshDays
 	}
-	conf.hours = time.Duration(conf.ExpireHours) * time.Hour
+	conf.refresh = time.Duration(conf.RefreshDays) * 24 * time.Hour
 	conf.key = []byte(conf.Secret)
 	localConf = &conf
 
@@ -54,17 +101,124 @@ func Configure() error {
 
 // New returns a new token
 func New(userid int64) (string, error) {
+	return NewSession(userid, 0)
+}
+
+// NewSession returns a new token for a login session
+func NewSession(userid, sessionid int64) (string, error) {
 	if localConf == nil {
 		if err := Configure(); err != nil {
 			return "", err
 		}
 	}
-	claims := Claims{UserID: userid}
+	jti, err := Random(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{UserID: userid, SessionID: sessionid}
+	claims.Id = jti
 	claims.Issuer = "apiserver"
-	claims.ExpiresAt = time.Now().Add(localConf.hours).Unix()
+	claims.setIssued(now)
+	claims.ExpiresAt = now.Add(localConf.access).Unix()
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(localConf.key)
 }
 
+// NewImpersonation returns a token for actorid to act as userid. It lasts ttl
+// and is not tied to a session. The jti is returned for auditing
+func NewImpersonation(userid, actorid int64, ttl time.Duration) (tok, jti string, err error) {
+	if localConf == nil {
+		if err := Configure(); err != nil {
+			return "", "", err
+		}
+	}
+	if jti, err = Random(16); err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	claims := Claims{UserID: userid, ActorID: actorid}
+	claims.Id = jti
+	claims.Issuer = "apiserver"
+	claims.setIssued(now)
+	claims.ExpiresAt = now.Add(ttl).Unix()
+	tok, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(localConf.key)
+	return tok, jti, err
+}
+
+// NewChallenge returns a short lived token for purpose. It is rejected by AuthToken
+// and must be read with DecodeChallenge
+func NewChallenge(userid int64, purpose string) (string, error) {
+	if localConf == nil {
+		if err := Configure(); err != nil {
+			return "", err
+		}
+	}
+	jti, err := Random(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{UserID: userid, Purpose: purpose}
+	claims.Id = jti
+	claims.Issuer = "apiserver"
+	claims.setIssued(now)
+	claims.ExpiresAt = now.Add(challengeTTL).Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(localConf.key)
+}
+
+// DecodeChallenge will return the claims of a challenge token issued for purpose
+func DecodeChallenge(tokenString, purpose string) (*Claims, error) {
+	claims, err := Decode(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("Token is not a %s token", purpose)
+	}
+	return claims, nil
+}
+
+// AccessTTL returns the lifetime of an access token
+func AccessTTL() time.Duration {
+	if localConf == nil {
+		if err := Configure(); err != nil {
+			return 0
+		}
+	}
+	return localConf.access
+}
+
+// RefreshTTL returns the lifetime of a refresh token
+func RefreshTTL() time.Duration {
+	if localConf == nil {
+		if err := Configure(); err != nil {
+			return defRefreshDays * 24 * time.Hour
+		}
+	}
+	return localConf.refresh
+}
+
+// NewRefresh returns a new opaque refresh token. Only the hash returned by
+// Hash should be stored
+func NewRefresh() (string, error) {
+	return Random(32)
+}
+
+// Hash returns the hex encoded sha256 hash of an opaque token
+func Hash(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// Random returns n random bytes encoded as a url safe string
+func Random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // AuthToken extracts and returns the JWT token from the auth header
 func AuthToken(r *http.Request) (*Claims, error) {
 	h := r.Header.Get("Authorization")
@@ -76,7 +230,27 @@ func AuthToken(r *http.Request) (*Claims, error) {
 	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
 		return nil, fmt.Errorf("Authorization header format must be Bearer {token}")
 	}
-	return Decode(parts[1])
+	claims, err := Decode(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("A %s token can not be used for authorization", claims.Purpose)
+	}
+	return claims, nil
+}
+
+// APIKey returns the api key from the X-API-Key header or an
+// Authorization: ApiKey {key} header. It returns "" if neither is set
+func APIKey(r *http.Request) string {
+	if k := strings.TrimSpace(r.Header.Get("X-API-Key")); k != "" {
+		return k
+	}
+	parts := strings.Fields(r.Header.Get("Authorization"))
+	if len(parts) == 2 && strings.ToLower(parts[0]) == "apikey" {
+		return parts[1]
+	}
+	return ""
 }
 
 // Decode will return a claim from a token string
@@ -97,14 +271,33 @@ func Decode(tokenString string) (*Claims, error) {
 	return nil, fmt.Errorf("Failed to decode token")
 }
 
+// DeriveKey returns a key for signing something other than tokens. It is
+// derived from the jwt secret and purpose so signatures made for one purpose
+// are not valid for another
+func DeriveKey(purpose string) ([]byte, error) {
+	if localConf == nil {
+		if err := Configure(); err != nil {
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, localConf.key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil), nil
+}
+
 // SystemToken will generate a token for the system user. It is intended
 // for use with external processes
 func SystemToken(expire time.Time, secret []byte) (string, error) {
+	jti, err := Random(16)
+	if err != nil {
+		return "", err
+	}
 	claims := Claims{UserID: 1} // System user
+	claims.Id = jti
 	claims.Issuer = "apiserver"
 	claims.Subject = "System API Token"
 	// Slightly in the past (25s) to insure server timings don't invalidate token
-	claims.IssuedAt = time.Now().Add(-25 * time.Second).Unix()
+	claims.setIssued(time.Now().Add(-25 * time.Second))
 	claims.ExpiresAt = expire.Unix()
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
 }
@@ -7,10 +7,15 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/rajendraventurit/radicaapi/domain"
 	"github.com/rajendraventurit/radicaapi/handlers"
+	"github.com/rajendraventurit/radicaapi/lib/cors"
 	"github.com/rajendraventurit/radicaapi/lib/db"
 	"github.com/rajendraventurit/radicaapi/lib/env"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
 	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/password"
+	"github.com/rajendraventurit/radicaapi/lib/ratelimit"
 	"github.com/rajendraventurit/radicaapi/lib/routetable"
 	"github.com/rajendraventurit/radicaapi/lib/token"
 )
@@ -19,6 +24,11 @@ var rTable = routetable.RouteTable{}
 
 func main() {
 
+	// Logging
+	if err := logger.Configure(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Data store
 	ldb, err := db.Connect("")
 	if err != nil {
@@ -32,6 +42,22 @@ func main() {
 		logger.Fatal(err)
 	}
 
+	// Password hashing
+	if err := password.Configure(); err != nil {
+		logger.Fatal(err)
+	}
+
+	// Rate limits
+	if err := ratelimit.Configure(); err != nil {
+		logger.Fatal(err)
+	}
+	SetLimiter(ratelimit.New(ratelimit.NewMemoryStore()))
+
+	// Account policies
+	if err := domain.Configure(); err != nil {
+		logger.Fatal(err)
+	}
+
 	// http(s) Server
 	conf, err := loadConfig()
 	if err != nil {
@@ -41,11 +67,22 @@ func main() {
 	// routing
 	ev := env.New(ldb)
 	rTable = handlers.GetRoutes(ev)
+	if err := handler.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		logger.Fatal(err)
+	}
+	policy, err := cors.New(conf.CORS, rTable.Methods)
+	if err != nil {
+		logger.Fatal(err)
+	}
 	router := routetable.NewRouter()
-	router.AddMiddleware(newPermMiddleware)
-	router.AddMiddleware(newTokenHandler)
-	router.AddMiddleware(newHeaderHandler)
+	router.AddMiddleware(newRequestIDHandler)
 	router.AddMiddleware(newLogHandler)
+	router.AddMiddleware(newHeaderHandler)
+	router.AddMiddleware(policy.Handler)
+	router.AddMiddleware(newIPRateLimitMiddleware)
+	router.AddMiddleware(newTokenHandler)
+	router.AddMiddleware(newRateLimitMiddleware)
+	router.AddMiddleware(newPermMiddleware)
 	router.SetRouteTable(rTable)
 
 	adr := fmt.Sprintf("%v:%v", conf.Host, conf.Port)
@@ -60,10 +97,12 @@ func main() {
 const defConfPath = "/etc/radica/server.json"
 
 type config struct {
-	Host     string `json:"host"`
-	Port     int64  `json:"port"`
-	CertFile string `json:"cert_file"`
-	KeyFile  string `json:"key_file"`
+	Host           string      `json:"host"`
+	Port           int64       `json:"port"`
+	CertFile       string      `json:"cert_file"`
+	KeyFile        string      `json:"key_file"`
+	CORS           cors.Config `json:"cors"`
+	TrustedProxies []string    `json:"trusted_proxies"` // load balancer ips or cidrs whose forwarding headers are believed
 }
 
 func loadConfig() (*config, error) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,12 +12,19 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/rajendraventurit/radicaapi/domain"
+	"github.com/rajendraventurit/radicaapi/lib/handler"
 	"github.com/rajendraventurit/radicaapi/lib/logger"
+	"github.com/rajendraventurit/radicaapi/lib/ratelimit"
+	"github.com/rajendraventurit/radicaapi/lib/routetable"
+	"github.com/rajendraventurit/radicaapi/lib/serror"
 	"github.com/rajendraventurit/radicaapi/lib/token"
 )
 
 var localDB *sqlx.DB
 
+var limiter *ratelimit.Limiter
+
 const methodOpt = "OPTIONS"
 
 // SetLocalDB sets the DB for use in the middleware
@@ -24,25 +32,136 @@ func SetLocalDB(db *sqlx.DB) {
 	localDB = db
 }
 
-func newLogHandler(next http.Handler) http.Handler {
+// SetLimiter sets the rate limiter for use in the middleware
+func SetLimiter(l *ratelimit.Limiter) {
+	limiter = l
+}
+
+// maxRequestIDLen is the longest request id accepted from a client
+const maxRequestIDLen = 128
+
+// newRequestIDHandler sets a request id on the context and the response. A
+// well formed X-Request-ID from the client is kept, otherwise one is generated
+func newRequestIDHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.HTTPAccess(0, r)
+		id := r.Header.Get(logger.RequestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			if id, err = token.Random(16); err != nil {
+				logger.Errorf("token.Random %v", err)
+				id = ""
+			}
+		}
+		if id != "" {
+			w.Header().Set(logger.RequestIDHeader, id)
+			r = r.WithContext(logger.NewContext(r.Context(), id))
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// validRequestID returns true if id is short and safe to write to logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type ctxKey int
+
+const accessKey ctxKey = 0
+
+// accessInfo collects what inner middleware learns about a request for the
+// access log
+type accessInfo struct {
+	userID int64
+}
+
+// setAccessUser records the authenticated user of a request for the access log
+func setAccessUser(r *http.Request, userid int64) {
+	if a, ok := r.Context().Value(accessKey).(*accessInfo); ok {
+		a.userID = userid
+	}
+}
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets handlers stream through the writer
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newLogHandler writes an access log entry once a request completes
+func newLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &accessInfo{}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessKey, info)))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		a := logger.Access{
+			Time:      start,
+			RequestID: logger.RequestID(r.Context()),
+			ClientIP:  handler.ClientIP(r),
+			UserID:    info.userID,
+			Method:    r.Method,
+			URI:       r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Status:    sw.status,
+			Bytes:     sw.bytes,
+			Duration:  time.Since(start),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+		if route := routetable.RouteFromContext(r.Context()); route != nil {
+			a.Route = route.Name
+			a.Path = route.Path
+		}
+		logger.LogAccess(a)
+	})
+}
+
 func newHeaderHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Frame-Options", "DENY")
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
 		w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
 		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Accept")
-		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%v", 3600*time.Second))
-		w.Header().Set("Access-Control-Allow-Methods", rTable.Methods(r.URL.Path))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -53,50 +172,278 @@ func newTokenHandler(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		route, err := rTable.GetRoute(r.Method, r.URL.Path)
-		if err != nil {
-			logger.Errorf("Route not found %v", err)
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		route := routetable.RouteFromContext(r.Context())
+		if route == nil {
+			logger.ErrorfContext(r.Context(), "Route not found %v %v", r.Method, r.URL.Path)
+			serror.HTTPError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		if route.Insecure {
+			// sensitive routes open to everyone still refuse an impersonator
+			if claims, err := token.AuthToken(r); route.Sensitive && err == nil && claims.ActorID > 0 {
+				logger.ErrorfContext(r.Context(), "UserID %v impersonating %v may not use %v %v", claims.ActorID, claims.UserID, r.Method, r.URL.Path)
+				serror.HTTPError(w, "not available while impersonating", http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
-		if _, err := token.AuthToken(r); err != nil {
-			logger.Errorf(err.Error())
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		var p *token.Principal
+		var err error
+		if key := token.APIKey(r); key != "" {
+			p, err = apiKeyPrincipal(key, route)
+		} else {
+			p, err = tokenPrincipal(r)
+		}
+		if err != nil {
+			se, ok := err.(serror.Error)
+			if !ok {
+				se = serror.NewServer(err, "newTokenHandler")
+			}
+			se.Log(0, r)
+			serror.HTTPError(w, se.Status(), se.StatusCode())
+			return
+		}
+		setAccessUser(r, p.UserID)
+		next.ServeHTTP(w, r.WithContext(token.NewContext(r.Context(), p)))
+	})
+}
+
+// tokenPrincipal returns the principal for a bearer token
+func tokenPrincipal(r *http.Request) (*token.Principal, error) {
+	claims, err := token.AuthToken(r)
+	if err != nil {
+		return nil, serror.New(http.StatusUnauthorized, err, "token.AuthToken")
+	}
+	revoked, err := token.IsRevoked(localDB, claims)
+	if err != nil {
+		return nil, serror.NewServer(err, "token.IsRevoked")
+	}
+	if revoked {
+		return nil, serror.New(http.StatusUnauthorized, fmt.Errorf("UserID %v revoked token %v", claims.UserID, claims.Id), "token.IsRevoked")
+	}
+	roles, err := domain.GetUserRoles(localDB, claims.UserID)
+	if err != nil {
+		return nil, serror.NewServer(err, "domain.GetUserRoles")
+	}
+	if claims.SessionID > 0 {
+		err := domain.TouchSession(localDB, claims.UserID, claims.SessionID)
+		if err == domain.ErrSessionRevoked {
+			return nil, serror.New(http.StatusUnauthorized, fmt.Errorf("UserID %v session %v revoked", claims.UserID, claims.SessionID), "domain.TouchSession")
+		}
+		if err != nil {
+			return nil, serror.NewServer(err, "domain.TouchSession")
+		}
+	}
+	if claims.ActorID > 0 {
+		err := domain.RecordImpersonatedRequest(localDB, claims.Id, r.Method, r.URL.Path)
+		if err == domain.ErrImpersonationEnded {
+			return nil, serror.New(http.StatusUnauthorized, fmt.Errorf("UserID %v impersonation %v ended", claims.ActorID, claims.Id), "domain.RecordImpersonatedRequest")
+		}
+		if err != nil {
+			return nil, serror.NewServer(err, "domain.RecordImpersonatedRequest")
+		}
+		logger.MessagefContext(r.Context(), "IMPERSONATED admin %v as user %v %v %v", claims.ActorID, claims.UserID, r.Method, r.URL.Path)
+	}
+	verified, err := domain.IsEmailVerified(localDB, claims.UserID)
+	if err != nil {
+		return nil, serror.NewServer(err, "domain.IsEmailVerified")
+	}
+	return &token.Principal{
+		UserID:    claims.UserID,
+		Roles:     roles,
+		TokenID:   claims.Id,
+		SessionID: claims.SessionID,
+		Claims:    claims,
+		Verified:  verified,
+		ActorID:   claims.ActorID,
+	}, nil
+}
+
+// apiKeyPrincipal returns the principal for an api key. The key must hold
+// every scope the route declares
+func apiKeyPrincipal(key string, route *routetable.Route) (*token.Principal, error) {
+	k, err := domain.AuthenticateAPIKey(localDB, key)
+	if err == domain.ErrInvalidAPIKey {
+		return nil, serror.New(http.StatusUnauthorized, err, "domain.AuthenticateAPIKey")
+	}
+	if err != nil {
+		return nil, serror.NewServer(err, "domain.AuthenticateAPIKey")
+	}
+	if len(route.Scopes) == 0 || !k.HasScopes(route.Scopes...) {
+		return nil, serror.New(http.StatusForbidden, fmt.Errorf("API key %v lacks scopes %v", k.Prefix, route.Scopes), "apiKeyPrincipal")
+	}
+	roles, err := domain.GetUserRoles(localDB, k.UserID)
+	if err != nil {
+		return nil, serror.NewServer(err, "domain.GetUserRoles")
+	}
+	verified, err := domain.IsEmailVerified(localDB, k.UserID)
+	if err != nil {
+		return nil, serror.NewServer(err, "domain.IsEmailVerified")
+	}
+	return &token.Principal{
+		UserID:   k.UserID,
+		Roles:    roles,
+		APIKeyID: k.APIKeyID,
+		Scopes:   k.Scopes,
+		Verified: verified,
+	}, nil
+}
+
+// newRateLimitMiddleware limits requests from each client. Routes with a
+// RateLimit have buckets of their own, other routes share the default
+func newRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routetable.RouteFromContext(r.Context())
+		if strings.ToUpper(r.Method) == methodOpt || route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := "default"
+		if route.RateLimit != nil {
+			key = fmt.Sprintf("%s:%s", route.Method, route.Path)
+		}
+		key = fmt.Sprintf("%s:%s", key, rateLimitClient(r))
+		res, err := limiter.Allow(key, route.RateLimit)
+		if err != nil {
+			// a failing store should not take the api down
+			logger.ErrorfContext(r.Context(), "limiter.Allow %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		res.SetHeaders(w.Header())
+		if !res.Allowed {
+			logger.ErrorfContext(r.Context(), "Rate limit exceeded by %v for %v %v", rateLimitClient(r), r.Method, r.URL.Path)
+			writeRateLimited(w)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func newPermMiddleware(next http.Handler) http.Handler {
+// newIPRateLimitMiddleware limits every request from an ip. It runs before
+// authentication so invalid tokens and api keys are limited too, the
+// per client limits are applied once the principal is known
+func newIPRateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.ToUpper(r.Method) == methodOpt {
 			next.ServeHTTP(w, r)
 			return
 		}
-		route, err := rTable.GetRoute(r.Method, r.URL.Path)
+		ip := handler.ClientIP(r)
+		res, err := limiter.Allow("ip:"+ip, ratelimit.IPLimit())
 		if err != nil {
-			logger.Errorf("Route not found %v", err)
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			logger.ErrorfContext(r.Context(), "limiter.Allow %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !res.Allowed {
+			res.SetHeaders(w.Header())
+			logger.ErrorfContext(r.Context(), "IP rate limit exceeded by %v for %v %v", ip, r.Method, r.URL.Path)
+			writeRateLimited(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRateLimited writes the response to a refused request
+func writeRateLimited(w http.ResponseWriter) {
+	resp := serror.NewResponseJSON(false, "Too many requests", nil, http.StatusTooManyRequests)
+	resp.RequestID = w.Header().Get(logger.RequestIDHeader)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// rateLimitClient identifies the client of a request by api key, then user,
+// then ip
+func rateLimitClient(r *http.Request) string {
+	if p, ok := token.FromContext(r.Context()); ok {
+		if p.APIKeyID > 0 {
+			return fmt.Sprintf("key:%v", p.APIKeyID)
+		}
+		return fmt.Sprintf("user:%v", p.UserID)
+	}
+	return fmt.Sprintf("ip:%v", handler.ClientIP(r))
+}
+
+func newPermMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.ToUpper(r.Method) == methodOpt {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := routetable.RouteFromContext(r.Context())
+		if route == nil {
+			logger.ErrorfContext(r.Context(), "Route not found %v %v", r.Method, r.URL.Path)
+			serror.HTTPError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		if route.Insecure {
 			next.ServeHTTP(w, r)
 			return
 		}
-		_, err = token.AuthToken(r)
-		if err != nil {
-			logger.Errorf(err.Error())
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		p, ok := token.FromContext(r.Context())
+		if !ok {
+			logger.ErrorfContext(r.Context(), "No principal for %v %v", r.Method, r.URL.Path)
+			serror.HTTPError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !p.Verified && !domain.UnverifiedAllowed(route.AllowUnverified) {
+			logger.ErrorfContext(r.Context(), "UserID %v has not verified their email for %v %v", p.UserID, r.Method, r.URL.Path)
+			serror.HTTPError(w, domain.ErrEmailNotVerified.Error(), http.StatusForbidden)
+			return
+		}
+		if p.ActorID > 0 && route.Sensitive {
+			logger.ErrorfContext(r.Context(), "UserID %v impersonating %v may not use %v %v", p.ActorID, p.UserID, r.Method, r.URL.Path)
+			serror.HTTPError(w, "not available while impersonating", http.StatusForbidden)
+			return
+		}
+		var perms []int64
+		var err error
+		if route.OrgScoped {
+			orgID, err := getOrgID(r)
+			if err != nil {
+				logger.ErrorfContext(r.Context(), "getOrgID %v for %v %v", err, r.Method, r.URL.Path)
+				serror.HTTPError(w, "organization_id required", http.StatusBadRequest)
+				return
+			}
+			perms, err = domain.GetOrgPermissions(localDB, p.UserID, orgID)
+			if err == domain.ErrOrgNotFound {
+				serror.HTTPError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.ErrorfContext(r.Context(), "domain.GetOrgPermissions %v", err)
+				serror.HTTPError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			// callers without a role in the organization are not members
+			if len(perms) == 0 {
+				logger.ErrorfContext(r.Context(), "UserID %v is not a member of organization %v for %v %v", p.UserID, orgID, r.Method, r.URL.Path)
+				serror.HTTPError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			p.OrgID = orgID
+		} else {
+			if len(route.Permissions) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			perms, err = domain.GetUserPermissions(localDB, p.UserID)
+			if err != nil {
+				logger.ErrorfContext(r.Context(), "domain.GetUserPermissions %v", err)
+				serror.HTTPError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		if !domain.HasPermissions(perms, route.Permissions...) {
+			logger.ErrorfContext(r.Context(), "UserID %v lacks permissions %v for %v %v", p.UserID, route.Permissions, r.Method, r.URL.Path)
+			serror.HTTPError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 		next.ServeHTTP(w, r)
-		return
-
 	})
 }
 
@@ -113,7 +460,9 @@ func getOrgID(r *http.Request) (int64, error) {
 	// Restore the io.ReadCloser to its original state
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
 	mp := make(map[string]interface{})
-	if err := json.Unmarshal(bodyBytes, &mp); err != nil {
+	d := json.NewDecoder(bytes.NewReader(bodyBytes))
+	d.UseNumber() // large ids format as exponents from float64
+	if err := d.Decode(&mp); err != nil {
 		return 0, fmt.Errorf("Failed to decode json")
 	}
 	o, ok := mp["organization_id"]